@@ -0,0 +1,90 @@
+package expenses
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/plaid/plaid-go/v12/plaid"
+)
+
+func accountFromPlaid(ab plaid.AccountBase, updatedAt time.Time) Account {
+	acct := Account{
+		PlaidAccountId:   ab.AccountId,
+		AccountMask:      ab.GetMask(),
+		Type:             string(ab.Type),
+		Name:             ab.Name,
+		OfficialName:     ab.GetOfficialName(),
+		IsoCurrencyCode:  ab.Balances.GetIsoCurrencyCode(),
+		CurrentBalance:   ab.Balances.Current.Get(),
+		AvailableBalance: ab.Balances.Available.Get(),
+		BalanceUpdatedAt: &updatedAt,
+	}
+	if subtype := ab.GetSubtype(); subtype != "" {
+		acct.Subtype = string(subtype)
+	}
+	if acct.IsoCurrencyCode == "" {
+		acct.IsoCurrencyCode = ab.Balances.GetUnofficialCurrencyCode()
+	}
+
+	return acct
+}
+
+// refreshBalances fetches real-time balances for the item's accounts with
+// /accounts/balance/get and stores them.
+func (srv *Server) refreshBalances(ctx context.Context, item *Item) error {
+	abgreq := plaid.NewAccountsBalanceGetRequest(item.AccessToken)
+	abgres, _, err := srv.client.PlaidApi.AccountsBalanceGet(ctx).AccountsBalanceGetRequest(*abgreq).Execute()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	accounts := make([]Account, len(abgres.Accounts))
+	for i, ab := range abgres.Accounts {
+		accounts[i] = accountFromPlaid(ab, now)
+	}
+
+	if err = srv.db.CreateAccounts(ctx, accounts, item.PlaidItemId, item.PlaidInstitutionId); err != nil {
+		return err
+	}
+
+	return srv.db.RecordBalanceSnapshots(ctx, accounts, now)
+}
+
+// refreshAccounts refreshes the balances of every item's accounts
+func (srv *Server) refreshAccounts() http.HandlerFunc {
+	type response struct {
+		ErrorMsg string            `json:",omitempty"`
+		Errors   map[string]string `json:"errors,omitempty"` // keyed by item id
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+
+		var resp response
+
+		items, err := srv.db.RetrieveItems(req.Context())
+		if err != nil {
+			resp.ErrorMsg = err.Error()
+			returnJSON(w, http.StatusInternalServerError, resp)
+			return
+		}
+
+		for _, item := range items {
+			if err := srv.refreshBalances(req.Context(), item); err != nil {
+				log.Printf("Failed to refresh balances of item %s: %v", item.PlaidItemId, err)
+				if resp.Errors == nil {
+					resp.Errors = make(map[string]string)
+				}
+				resp.Errors[item.PlaidItemId] = err.Error()
+			}
+		}
+
+		returnJSON(w, http.StatusOK, resp)
+	}
+}
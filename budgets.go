@@ -0,0 +1,492 @@
+package expenses
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+const (
+	monthLayout = "2006-01"
+
+	// Budgets at least this fraction spent are near their limit
+	budgetNearThreshold = 0.9
+)
+
+// Budget statuses
+const (
+	BudgetStatusOK   = "ok"
+	BudgetStatusNear = "near"
+	BudgetStatusOver = "over"
+)
+
+var (
+	errUnknownBudget    = errors.New("unknown budget")
+	errBudgetAmount     = errors.New("budget amount must be positive")
+	errBudgetMonth      = errors.New("bad month, expected YYYY-MM")
+	errDuplicateBudget  = errors.New("category already has a budget")
+	errBudgetNoCategory = errors.New("budget needs a category")
+)
+
+// Budget limits monthly spending in a category and its subcategories
+type Budget struct {
+	Id         int     `json:"id"`
+	CategoryId int     `json:"category_id"`
+	Amount     float64 `json:"amount"`
+	Rollover   bool    `json:"rollover"`    // unspent amounts carry over to the next month
+	StartMonth string  `json:"start_month"` // YYYY-MM, rollover counts from here
+}
+
+// BudgetStatus is the progress of a budget in one month
+type BudgetStatus struct {
+	Budget
+	CategoryName string  `json:"category_name"`
+	Month        string  `json:"month"`
+	RolledOver   float64 `json:"rolled_over"` // carried from previous months
+	Available    float64 `json:"available"`   // the budget plus what rolled over
+	Spent        float64 `json:"spent"`
+	Remaining    float64 `json:"remaining"`
+	Status       string  `json:"status"`
+}
+
+func parseMonth(s string) (time.Time, error) {
+	m, err := time.Parse(monthLayout, s)
+	if err != nil {
+		return m, errBudgetMonth
+	}
+
+	return m, nil
+}
+
+func (db *DB) RetrieveBudgets(ctx context.Context) ([]*Budget, error) {
+	rows, err := db.db.QueryContext(
+		ctx,
+		`SELECT id, category_id, amount, rollover, start_month
+		 FROM budgets
+		 ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var budgets []*Budget
+	for rows.Next() {
+		b := new(Budget)
+		if err := rows.Scan(&b.Id, &b.CategoryId, &b.Amount, &b.Rollover, &b.StartMonth); err != nil {
+			return nil, err
+		}
+		budgets = append(budgets, b)
+	}
+
+	return budgets, rows.Err()
+}
+
+// RetrieveBudgetByCategory returns the budget of a category, whatever month
+// it starts in, or nil if the category has none
+func (db *DB) RetrieveBudgetByCategory(ctx context.Context, categoryId int) (*Budget, error) {
+	b := new(Budget)
+	err := db.db.QueryRowContext(
+		ctx,
+		`SELECT id, category_id, amount, rollover, start_month
+		 FROM budgets
+		 WHERE category_id=$1`, categoryId).Scan(&b.Id, &b.CategoryId, &b.Amount, &b.Rollover, &b.StartMonth)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// SaveBudget creates b if it has no id, otherwise updates it. A new budget
+// without a start month starts this month.
+func (db *DB) SaveBudget(ctx context.Context, b *Budget) error {
+	if b.CategoryId == 0 {
+		return errBudgetNoCategory
+	}
+	if toCents(b.Amount) <= 0 {
+		return errBudgetAmount
+	}
+	b.Amount = float64(toCents(b.Amount)) / 100
+	if b.StartMonth == "" {
+		b.StartMonth = time.Now().Format(monthLayout)
+	}
+	if _, err := parseMonth(b.StartMonth); err != nil {
+		return err
+	}
+	if err := categoryExists(ctx, db.db, b.CategoryId); err != nil {
+		return err
+	}
+
+	if b.Id == 0 {
+		res, err := db.db.ExecContext(
+			ctx,
+			`INSERT INTO budgets (category_id, amount, rollover, start_month)
+			 VALUES ($1, $2, $3, $4)`, b.CategoryId, b.Amount, b.Rollover, b.StartMonth)
+		if err != nil {
+			return budgetError(err)
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		b.Id = int(id)
+	} else {
+		res, err := db.db.ExecContext(
+			ctx,
+			`UPDATE budgets
+			 SET category_id=$1, amount=$2, rollover=$3, start_month=$4
+			 WHERE id=$5`, b.CategoryId, b.Amount, b.Rollover, b.StartMonth, b.Id)
+		if err != nil {
+			return budgetError(err)
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return errUnknownBudget
+		}
+	}
+
+	return nil
+}
+
+// budgetError reports a second budget for a category as errDuplicateBudget
+func budgetError(err error) error {
+	var serr sqlite3.Error
+	if errors.As(err, &serr) && serr.ExtendedCode == sqlite3.ErrConstraintUnique {
+		return errDuplicateBudget
+	}
+
+	return err
+}
+
+func (db *DB) DeleteBudget(ctx context.Context, id int) error {
+	res, err := db.db.ExecContext(ctx, `DELETE FROM budgets WHERE id=$1`, id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errUnknownBudget
+	}
+
+	return nil
+}
+
+// monthlySpending totals allocations by month and category for months from
+// start to end inclusive. Pending transactions count, deleted and hidden
+// ones and transfers don't.
+func (db *DB) monthlySpending(ctx context.Context, start, end time.Time) (map[string]map[int]float64, error) {
+	rows, err := db.db.QueryContext(
+		ctx,
+		`SELECT substr(al.date, 1, 7), al.category_id, SUM(al.amount)
+		 FROM (`+transactionAllocationsSQL+`) al
+		 WHERE al.date>=$1 AND al.date<$2 AND al.category_id IS NOT NULL
+			AND NOT al.deleted AND NOT al.hidden AND al.kind<>'transfer'
+		 GROUP BY 1, 2`, start.Format(time.DateOnly), end.AddDate(0, 1, 0).Format(time.DateOnly))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	spending := make(map[string]map[int]float64)
+	for rows.Next() {
+		var month string
+		var categoryId int
+		var amount float64
+		if err := rows.Scan(&month, &categoryId, &amount); err != nil {
+			return nil, err
+		}
+		if spending[month] == nil {
+			spending[month] = make(map[int]float64)
+		}
+		spending[month][categoryId] = amount
+	}
+
+	return spending, rows.Err()
+}
+
+// rollUpSpending adds the spending of each category to all of its ancestors
+func rollUpSpending(spending map[int]float64, categories []*Category) map[int]float64 {
+	parents := make(map[int]*int, len(categories))
+	for _, c := range categories {
+		parents[c.Id] = c.ParentId
+	}
+
+	total := make(map[int]float64, len(spending))
+	for id, amount := range spending {
+		// The depth bound guards against cycles that slipped into the table
+		for cur, depth := &id, 0; cur != nil && depth <= len(categories); depth++ {
+			total[*cur] += amount
+			cur = parents[*cur]
+		}
+	}
+
+	return total
+}
+
+// BudgetProgress returns the status of every budget active in month
+// (YYYY-MM), ordered by how much of the budget is used.
+func (db *DB) BudgetProgress(ctx context.Context, month string) ([]*BudgetStatus, error) {
+	target, err := parseMonth(month)
+	if err != nil {
+		return nil, err
+	}
+
+	budgets, err := db.RetrieveBudgets(ctx)
+	if err != nil {
+		return nil, err
+	}
+	categories, err := db.RetrieveCategories(ctx)
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[int]string)
+	for _, c := range categoryPaths(categories) {
+		names[c.Id] = c.Path
+	}
+
+	earliest := target
+	for _, b := range budgets {
+		if start, err := parseMonth(b.StartMonth); err == nil && start.Before(earliest) {
+			earliest = start
+		}
+	}
+	spending, err := db.monthlySpending(ctx, earliest, target)
+	if err != nil {
+		return nil, err
+	}
+	rolledUp := make(map[string]map[int]float64, len(spending))
+	for m, perCategory := range spending {
+		rolledUp[m] = rollUpSpending(perCategory, categories)
+	}
+
+	var statuses []*BudgetStatus
+	for _, b := range budgets {
+		start, err := parseMonth(b.StartMonth)
+		if err != nil || start.After(target) {
+			continue
+		}
+
+		// Carry what was left unspent forward, overspending isn't carried
+		var carry int64
+		if b.Rollover {
+			for m := start; m.Before(target); m = m.AddDate(0, 1, 0) {
+				carry += toCents(b.Amount) - toCents(rolledUp[m.Format(monthLayout)][b.CategoryId])
+				if carry < 0 {
+					carry = 0
+				}
+			}
+		}
+
+		available := toCents(b.Amount) + carry
+		spent := toCents(rolledUp[month][b.CategoryId])
+		bs := &BudgetStatus{
+			Budget:       *b,
+			CategoryName: names[b.CategoryId],
+			Month:        month,
+			RolledOver:   float64(carry) / 100,
+			Available:    float64(available) / 100,
+			Spent:        float64(spent) / 100,
+			Remaining:    float64(available-spent) / 100,
+			Status:       BudgetStatusOK,
+		}
+		switch {
+		case spent > available:
+			bs.Status = BudgetStatusOver
+		case float64(spent) >= budgetNearThreshold*float64(available):
+			bs.Status = BudgetStatusNear
+		}
+		statuses = append(statuses, bs)
+	}
+	sort.SliceStable(statuses, func(i, j int) bool {
+		return statuses[i].Spent/statuses[i].Available > statuses[j].Spent/statuses[j].Available
+	})
+
+	return statuses, nil
+}
+
+// statusForBudgetError maps errors from changing budgets to HTTP statuses
+func statusForBudgetError(err error) int {
+	switch {
+	case errors.Is(err, errUnknownBudget):
+		return http.StatusNotFound
+	case errors.Is(err, errDuplicateBudget):
+		return http.StatusConflict
+	case errors.Is(err, errUnknownCategory), errors.Is(err, errBudgetAmount),
+		errors.Is(err, errBudgetMonth), errors.Is(err, errBudgetNoCategory):
+		return http.StatusBadRequest
+	}
+
+	return http.StatusInternalServerError
+}
+
+// budgetMonth reads the month query parameter, defaulting to this month
+func budgetMonth(req *http.Request) (string, error) {
+	month := req.URL.Query().Get("month")
+	if month == "" {
+		return time.Now().Format(monthLayout), nil
+	}
+	if _, err := parseMonth(month); err != nil {
+		return "", fmt.Errorf("%w: %q", err, month)
+	}
+
+	return month, nil
+}
+
+// budgets reports the progress of every budget in the month query parameter
+// on GET, or with the category_id parameter returns that category's budget.
+// On POST it creates or updates a budget.
+func (srv *Server) budgets() http.HandlerFunc {
+	type response struct {
+		ErrorMsg string          `json:",omitempty"`
+		Month    string          `json:"month,omitempty"`
+		Budgets  []*BudgetStatus `json:"budgets,omitempty"`
+		Budget   *Budget         `json:"budget,omitempty"`
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		var resp response
+
+		switch {
+		case req.Method == http.MethodGet && req.URL.Query().Has("category_id"):
+			s := req.URL.Query().Get("category_id")
+			categoryId, err := strconv.Atoi(s)
+			if err != nil {
+				resp.ErrorMsg = fmt.Sprintf("bad category_id %q", s)
+				returnJSON(w, http.StatusBadRequest, resp)
+				return
+			}
+			if resp.Budget, err = srv.db.RetrieveBudgetByCategory(req.Context(), categoryId); err != nil {
+				resp.ErrorMsg = err.Error()
+				returnJSON(w, http.StatusInternalServerError, resp)
+				return
+			}
+		case req.Method == http.MethodGet:
+			month, err := budgetMonth(req)
+			if err != nil {
+				resp.ErrorMsg = err.Error()
+				returnJSON(w, http.StatusBadRequest, resp)
+				return
+			}
+			resp.Month = month
+
+			statuses, err := srv.db.BudgetProgress(req.Context(), month)
+			if err != nil {
+				resp.ErrorMsg = err.Error()
+				returnJSON(w, http.StatusInternalServerError, resp)
+				return
+			}
+			resp.Budgets = statuses
+			if resp.Budgets == nil {
+				resp.Budgets = []*BudgetStatus{}
+			}
+		case req.Method == http.MethodPost:
+			b := new(Budget)
+			if err := json.NewDecoder(req.Body).Decode(b); err != nil {
+				resp.ErrorMsg = err.Error()
+				returnJSON(w, http.StatusBadRequest, resp)
+				return
+			}
+			if err := srv.db.SaveBudget(req.Context(), b); err != nil {
+				resp.ErrorMsg = err.Error()
+				returnJSON(w, statusForBudgetError(err), resp)
+				return
+			}
+			resp.Budget = b
+		default:
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+
+		returnJSON(w, http.StatusOK, resp)
+	}
+}
+
+func (srv *Server) deleteBudget() http.HandlerFunc {
+	type payload struct {
+		Id int `json:"id"`
+	}
+
+	type response struct {
+		ErrorMsg string `json:",omitempty"`
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+
+		var resp response
+
+		pay := payload{}
+		if err := json.NewDecoder(req.Body).Decode(&pay); err != nil {
+			resp.ErrorMsg = err.Error()
+			returnJSON(w, http.StatusBadRequest, resp)
+			return
+		}
+		if err := srv.db.DeleteBudget(req.Context(), pay.Id); err != nil {
+			resp.ErrorMsg = err.Error()
+			returnJSON(w, statusForBudgetError(err), resp)
+			return
+		}
+
+		returnJSON(w, http.StatusOK, resp)
+	}
+}
+
+// budgetsPage shows the progress of each budget in a month, worst first
+func (srv *Server) budgetsPage() http.HandlerFunc {
+	type page struct {
+		ErrorMsg   string
+		Month      string
+		Prev, Next string
+		Budgets    []*BudgetStatus
+		Categories []CategoryPath
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+
+		var p page
+		month, err := budgetMonth(req)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			p.ErrorMsg = err.Error()
+			budgetsTmpl.Execute(w, p)
+			return
+		}
+		m, _ := parseMonth(month)
+		p.Month = month
+		p.Prev = m.AddDate(0, -1, 0).Format(monthLayout)
+		p.Next = m.AddDate(0, 1, 0).Format(monthLayout)
+
+		if p.Budgets, err = srv.db.BudgetProgress(req.Context(), month); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		categories, err := srv.db.RetrieveCategories(req.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		p.Categories = categoryPaths(categories)
+
+		budgetsTmpl.Execute(w, p)
+	}
+}
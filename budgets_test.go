@@ -0,0 +1,119 @@
+package expenses
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/plaid/plaid-go/v12/plaid"
+)
+
+func TestBudgetProgress(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+
+	added := []plaid.Transaction{
+		testTransaction("t1", "a1", "2023-05-10", "Safeway", 60),
+		testTransaction("t2", "a1", "2023-06-02", "Safeway", 100),
+		testTransaction("t3", "a1", "2023-06-20", "Costco", 30),
+	}
+	if _, err := db.UpdatePlaidTransactions(ctx, added, nil, nil, "item1", "c1"); err != nil {
+		t.Fatal(err)
+	}
+
+	categories, err := db.RetrieveCategories(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var food *Category
+	for _, c := range categories {
+		if c.Name == "Food & Drink" {
+			food = c
+		}
+	}
+	if food == nil {
+		t.Fatal("no Food & Drink category")
+	}
+	groceries := &Category{Name: "Groceries", ParentId: &food.Id}
+	if err := db.SaveCategory(ctx, groceries); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetCategoryMapping(ctx, "FOOD_AND_DRINK_GROCERIES", groceries.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	foodBudget := &Budget{CategoryId: food.Id, Amount: 100, Rollover: true, StartMonth: "2023-05"}
+	if err := db.SaveBudget(ctx, foodBudget); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SaveBudget(ctx, &Budget{CategoryId: groceries.Id, Amount: 150, StartMonth: "2023-06"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SaveBudget(ctx, &Budget{CategoryId: food.Id, Amount: 10, StartMonth: "2023-05"}); !errors.Is(err, errDuplicateBudget) {
+		t.Errorf("got %v for a second budget on a category, want %v", err, errDuplicateBudget)
+	}
+	if err := db.SaveBudget(ctx, &Budget{CategoryId: groceries.Id, Amount: 10, StartMonth: "June"}); !errors.Is(err, errBudgetMonth) {
+		t.Errorf("got %v for a bad start month, want %v", err, errBudgetMonth)
+	}
+
+	progress := func(month string) map[int]*BudgetStatus {
+		t.Helper()
+		statuses, err := db.BudgetProgress(ctx, month)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make(map[int]*BudgetStatus)
+		for _, bs := range statuses {
+			got[bs.CategoryId] = bs
+		}
+		return got
+	}
+
+	// Grocery spending counts towards the Food & Drink budget, and the 40
+	// left over in May rolls over
+	got := progress("2023-06")
+	if bs := got[food.Id]; bs == nil || bs.RolledOver != 40 || bs.Available != 140 || bs.Spent != 130 || bs.Status != BudgetStatusNear {
+		t.Errorf("got Food & Drink %+v in June, want 130 of 140 spent and near", bs)
+	}
+	if bs := got[groceries.Id]; bs == nil || bs.RolledOver != 0 || bs.Remaining != 20 || bs.Status != BudgetStatusOK {
+		t.Errorf("got Groceries %+v in June, want 20 remaining", bs)
+	}
+
+	// Groceries without rollover starts afresh, Food & Drink carries 10
+	got = progress("2023-07")
+	if bs := got[food.Id]; bs == nil || bs.Available != 110 || bs.Spent != 0 {
+		t.Errorf("got Food & Drink %+v in July, want 110 available", bs)
+	}
+	if bs := got[groceries.Id]; bs == nil || bs.Available != 150 {
+		t.Errorf("got Groceries %+v in July, want 150 available", bs)
+	}
+
+	// The groceries budget hasn't started in May
+	got = progress("2023-05")
+	if _, ok := got[groceries.Id]; ok || got[food.Id] == nil {
+		t.Errorf("got budgets %v in May, want only Food & Drink", got)
+	}
+	// but can still be found to edit it
+	b, err := db.RetrieveBudgetByCategory(ctx, groceries.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b == nil || b.Amount != 150 || b.StartMonth != "2023-06" {
+		t.Errorf("got Groceries budget %+v, want 150 from 2023-06", b)
+	}
+
+	foodBudget.Amount = 50
+	if err := db.SaveBudget(ctx, foodBudget); err != nil {
+		t.Fatal(err)
+	}
+	if bs := progress("2023-06")[food.Id]; bs.RolledOver != 0 || bs.Status != BudgetStatusOver {
+		t.Errorf("got Food & Drink %+v in June, want over with nothing rolled over", bs)
+	}
+
+	if err := db.DeleteBudget(ctx, foodBudget.Id); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteBudget(ctx, foodBudget.Id); !errors.Is(err, errUnknownBudget) {
+		t.Errorf("got %v deleting a deleted budget, want %v", err, errUnknownBudget)
+	}
+}
@@ -0,0 +1,195 @@
+package expenses
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// Kinds of transaction
+const (
+	KindIncome   = "income"
+	KindExpense  = "expense"
+	KindTransfer = "transfer" // between our own accounts, neither spending nor income
+)
+
+var errUnknownKind = errors.New("kind must be income, expense or transfer")
+
+// transactionKindSQL classifies a transaction t as one of the kinds. A kind
+// set by hand wins, then a rule marking it a transfer, then being one leg of
+// a matched transfer pair, then Plaid's category.
+// Money in without a Plaid category is income. Everything else is an expense,
+// so refunds offset spending rather than counting as income. It needs the
+// joins in effectiveCategoryJoinsSQL.
+const transactionKindSQL = `COALESCE(o.kind, CASE
+	WHEN COALESCE(r.transfer, 0) THEN 'transfer'
+	WHEN EXISTS (
+		SELECT 1 FROM transfer_pairs tp
+		WHERE tp.status='matched' AND t.plaid_transaction_id IN (tp.out_transaction_id, tp.in_transaction_id)) THEN 'transfer'
+	WHEN t.category IN ('TRANSFER_IN', 'TRANSFER_OUT') OR t.category_detailed='LOAN_PAYMENTS_CREDIT_CARD_PAYMENT' THEN 'transfer'
+	WHEN t.category='INCOME' OR (COALESCE(t.category, '')='' AND t.amount<0) THEN 'income'
+	ELSE 'expense' END)`
+
+func validKind(kind string) bool {
+	return kind == KindIncome || kind == KindExpense || kind == KindTransfer
+}
+
+// SetTransactionKind overrides how a transaction is classified, an empty kind
+// goes back to classifying it automatically.
+func (db *DB) SetTransactionKind(ctx context.Context, plaidTransactionId, kind string) error {
+	if kind == "" {
+		return clearOverride(ctx, db.db, "kind", plaidTransactionId)
+	}
+	if !validKind(kind) {
+		return errUnknownKind
+	}
+	if err := transactionExists(ctx, db.db, plaidTransactionId); err != nil {
+		return err
+	}
+
+	_, err := db.db.ExecContext(
+		ctx,
+		`INSERT INTO transaction_overrides (plaid_transaction_id, kind)
+		 VALUES ($1, $2)
+		 ON CONFLICT (plaid_transaction_id) DO UPDATE SET kind=excluded.kind, updated_at=CURRENT_TIMESTAMP`,
+		plaidTransactionId, kind)
+	return err
+}
+
+// CashFlow is the money in and out of an account in a month, positive both
+// ways. Transfers between our own accounts are kept apart from income and
+// expenses.
+type CashFlow struct {
+	Month          string  `json:"month"` // YYYY-MM
+	PlaidAccountId string  `json:"account_id"`
+	AccountName    string  `json:"account_name"`
+	Income         float64 `json:"income"`
+	Expenses       float64 `json:"expenses"`
+	TransfersIn    float64 `json:"transfers_in"`
+	TransfersOut   float64 `json:"transfers_out"`
+	Net            float64 `json:"net"` // the change in the account, transfers included
+}
+
+// CashFlowByAccount returns the cash flow of each account with transactions
+// in each month from start to end inclusive, ordered by month then account.
+func (db *DB) CashFlowByAccount(ctx context.Context, start, end string) ([]*CashFlow, error) {
+	rows, err := db.db.QueryContext(
+		ctx,
+		`SELECT substr(al.date, 1, 7), al.plaid_account_id,
+			COALESCE(NULLIF(a.name, ''), al.plaid_account_id) || COALESCE(' ...' || NULLIF(a.account_mask, ''), ''),
+			COALESCE(-SUM(CASE WHEN al.kind='income' THEN al.amount END), 0),
+			COALESCE(SUM(CASE WHEN al.kind='expense' THEN al.amount END), 0),
+			COALESCE(-SUM(CASE WHEN al.kind='transfer' AND al.amount<0 THEN al.amount END), 0),
+			COALESCE(SUM(CASE WHEN al.kind='transfer' AND al.amount>0 THEN al.amount END), 0),
+			-SUM(al.amount)
+		 FROM (`+transactionAllocationsSQL+`) al
+		 LEFT JOIN accounts a ON a.plaid_account_id=al.plaid_account_id
+		 WHERE al.date>=$1 AND al.date<=$2 AND `+reportFilterSQL+`
+		 GROUP BY 1, 2
+		 ORDER BY 1, 3`, start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var flows []*CashFlow
+	for rows.Next() {
+		cf := new(CashFlow)
+		err := rows.Scan(&cf.Month, &cf.PlaidAccountId, &cf.AccountName,
+			&cf.Income, &cf.Expenses, &cf.TransfersIn, &cf.TransfersOut, &cf.Net)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range []*float64{&cf.Income, &cf.Expenses, &cf.TransfersIn, &cf.TransfersOut, &cf.Net} {
+			*v = float64(toCents(*v)) / 100
+		}
+		flows = append(flows, cf)
+	}
+
+	return flows, rows.Err()
+}
+
+// cashFlow reports the cash flow of each account per month between the start
+// and end query parameters
+func (srv *Server) cashFlow() http.HandlerFunc {
+	type response struct {
+		ErrorMsg string      `json:",omitempty"`
+		Start    string      `json:"start"`
+		End      string      `json:"end"`
+		Accounts []*CashFlow `json:"accounts"`
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+
+		var resp response
+
+		start, end, err := reportPeriod(req)
+		if err != nil {
+			resp.ErrorMsg = err.Error()
+			returnJSON(w, http.StatusBadRequest, resp)
+			return
+		}
+		resp.Start, resp.End = start, end
+
+		flows, err := srv.db.CashFlowByAccount(req.Context(), start, end)
+		if err != nil {
+			resp.ErrorMsg = err.Error()
+			returnJSON(w, http.StatusInternalServerError, resp)
+			return
+		}
+		resp.Accounts = flows
+		if resp.Accounts == nil {
+			resp.Accounts = []*CashFlow{}
+		}
+
+		returnJSON(w, http.StatusOK, resp)
+	}
+}
+
+// setTransactionKind classifies one transaction by hand, an empty kind goes
+// back to classifying it automatically
+func (srv *Server) setTransactionKind() http.HandlerFunc {
+	type payload struct {
+		TransactionId string `json:"transaction_id"`
+		Kind          string `json:"kind"`
+	}
+
+	type response struct {
+		ErrorMsg string `json:",omitempty"`
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+
+		var resp response
+
+		pay := payload{}
+		if err := json.NewDecoder(req.Body).Decode(&pay); err != nil {
+			resp.ErrorMsg = err.Error()
+			returnJSON(w, http.StatusBadRequest, resp)
+			return
+		}
+		if err := srv.db.SetTransactionKind(req.Context(), pay.TransactionId, pay.Kind); err != nil {
+			resp.ErrorMsg = err.Error()
+			status := http.StatusInternalServerError
+			switch {
+			case errors.Is(err, errUnknownTransaction):
+				status = http.StatusNotFound
+			case errors.Is(err, errUnknownKind):
+				status = http.StatusBadRequest
+			}
+			returnJSON(w, status, resp)
+			return
+		}
+
+		returnJSON(w, http.StatusOK, resp)
+	}
+}
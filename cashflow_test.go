@@ -0,0 +1,100 @@
+package expenses
+
+import (
+	"context"
+	"testing"
+
+	"github.com/plaid/plaid-go/v12/plaid"
+)
+
+func TestCashFlow(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+
+	withCategory := func(txn plaid.Transaction, primary, detailed string) plaid.Transaction {
+		txn.SetPersonalFinanceCategory(plaid.PersonalFinanceCategory{Primary: primary, Detailed: detailed})
+		return txn
+	}
+	salary := testTransaction("t1", "checking", "2023-06-01", "Employer", -1000)
+	salary.UnsetPersonalFinanceCategory()
+	added := []plaid.Transaction{
+		salary,
+		withCategory(testTransaction("t2", "checking", "2023-06-05", "Card payment", 200),
+			"LOAN_PAYMENTS", "LOAN_PAYMENTS_CREDIT_CARD_PAYMENT"),
+		withCategory(testTransaction("t3", "card", "2023-06-05", "Payment received", -200),
+			"TRANSFER_IN", "TRANSFER_IN_ACCOUNT_TRANSFER"),
+		testTransaction("t4", "card", "2023-06-10", "Safeway", 50),
+		testTransaction("t5", "card", "2023-06-12", "Safeway", -10),
+		testTransaction("t6", "checking", "2023-06-15", "Venmo", 100),
+	}
+	if _, err := db.UpdatePlaidTransactions(ctx, added, nil, nil, "item1", "c1"); err != nil {
+		t.Fatal(err)
+	}
+
+	kinds := func() map[string]string {
+		t.Helper()
+		txns, err := db.QueryTransactions(ctx, TransactionFilter{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make(map[string]string)
+		for _, txn := range txns {
+			got[txn.PlaidTransactionId] = txn.Kind
+		}
+		return got
+	}
+	got := kinds()
+	want := map[string]string{"t1": KindIncome, "t2": KindTransfer, "t3": KindTransfer, "t4": KindExpense, "t5": KindExpense, "t6": KindExpense}
+	for id, kind := range want {
+		if got[id] != kind {
+			t.Errorf("got %s classified as %q, want %q", id, got[id], kind)
+		}
+	}
+
+	// Money sent to ourselves through Venmo
+	if err := db.SetTransactionKind(ctx, "t6", KindTransfer); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetTransactionKind(ctx, "t6", "gift"); err != errUnknownKind {
+		t.Errorf("got %v for a bad kind, want %v", err, errUnknownKind)
+	}
+	txns, err := db.QueryTransactions(ctx, TransactionFilter{Kind: KindTransfer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txns) != 3 || !txns[0].KindOverridden {
+		t.Errorf("got %d transfers, want t2, t3 and the overridden t6", len(txns))
+	}
+
+	months, err := db.MonthlySummaries(ctx, "2023-06-01", "2023-06-30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := months[0]; m.Income != 1000 || m.Expenses != 40 || m.Net != 960 {
+		t.Errorf("got June %+v, want 1000 in and 40 out", m)
+	}
+
+	flows, err := db.CashFlowByAccount(ctx, "2023-06-01", "2023-06-30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	byAccount := make(map[string]*CashFlow)
+	for _, cf := range flows {
+		byAccount[cf.PlaidAccountId] = cf
+	}
+	if cf := byAccount["checking"]; cf == nil || cf.Income != 1000 || cf.Expenses != 0 || cf.TransfersOut != 300 || cf.Net != 700 {
+		t.Errorf("got checking %+v, want 1000 in, 300 transferred out", cf)
+	}
+	if cf := byAccount["card"]; cf == nil || cf.Expenses != 40 || cf.TransfersIn != 200 || cf.Net != 160 {
+		t.Errorf("got card %+v, want 40 spent and 200 transferred in", cf)
+	}
+
+	// Clearing the override classifies t6 automatically again, without
+	// touching its category
+	if err := db.SetTransactionKind(ctx, "t6", ""); err != nil {
+		t.Fatal(err)
+	}
+	if got := kinds(); got["t6"] != KindExpense {
+		t.Errorf("got t6 classified as %q after clearing, want expense", got["t6"])
+	}
+}
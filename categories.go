@@ -0,0 +1,515 @@
+package expenses
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+var (
+	errUnknownCategory      = errors.New("unknown category")
+	errCategoryName         = errors.New("category needs a name")
+	errCategoryHasChild     = errors.New("category has subcategories")
+	errCategoryCycle        = errors.New("category cannot be its own ancestor")
+	errMissingPlaidCategory = errors.New("missing Plaid category")
+)
+
+// Category is one of our own categories, which replace Plaid's inconsistent
+// taxonomy. Categories nest under ParentId.
+type Category struct {
+	Id       int    `json:"id"`
+	Name     string `json:"name"`
+	ParentId *int   `json:"parent_id"`
+	Color    string `json:"color,omitempty"`
+	Icon     string `json:"icon,omitempty"`
+}
+
+// CategoryMapping maps a Plaid personal_finance_category, primary or detailed,
+// to one of our categories.
+type CategoryMapping struct {
+	PlaidCategory string `json:"plaid_category"`
+	CategoryId    int    `json:"category_id"`
+}
+
+// effectiveCategorySQL is the id of the category a transaction t falls under:
+// a manual override, else one set by a rule, else a mapping of its detailed
+// Plaid category, else a mapping of its primary Plaid category. It needs the
+// joins in effectiveCategoryJoinsSQL.
+const effectiveCategorySQL = "COALESCE(o.category_id, r.category_id, md.category_id, mp.category_id)"
+
+const effectiveCategoryJoinsSQL = `
+LEFT JOIN transaction_overrides o ON o.plaid_transaction_id=t.plaid_transaction_id
+LEFT JOIN rule_results r ON r.plaid_transaction_id=t.plaid_transaction_id
+LEFT JOIN category_mappings md ON md.plaid_category=t.category_detailed
+LEFT JOIN category_mappings mp ON mp.plaid_category=t.category`
+
+// categoryJoinsSQL also joins the effective category as c
+const categoryJoinsSQL = effectiveCategoryJoinsSQL + `
+LEFT JOIN categories c ON c.id=` + effectiveCategorySQL
+
+// categoryTreeSQL selects the ids of the category with the id in the
+// placeholder and of all its descendants
+const categoryTreeSQL = `
+WITH RECURSIVE tree(id) AS (
+	SELECT id FROM categories WHERE id=%s
+	UNION
+	SELECT categories.id FROM categories JOIN tree ON categories.parent_id=tree.id
+)
+SELECT id FROM tree`
+
+// CategoryPath is a category named by its place in the hierarchy, e.g.
+// "Food & Drink / Groceries"
+type CategoryPath struct {
+	Id   int
+	Path string
+}
+
+// categoryPaths returns the full path of each category, sorted by path
+func categoryPaths(categories []*Category) []CategoryPath {
+	byId := make(map[int]*Category, len(categories))
+	for _, c := range categories {
+		byId[c.Id] = c
+	}
+
+	paths := make([]CategoryPath, len(categories))
+	for i, c := range categories {
+		path := c.Name
+		// The depth bound guards against cycles that slipped into the table
+		for p, depth := c.ParentId, 0; p != nil && depth < len(categories); depth++ {
+			parent, ok := byId[*p]
+			if !ok {
+				break
+			}
+			path = parent.Name + " / " + path
+			p = parent.ParentId
+		}
+		paths[i] = CategoryPath{Id: c.Id, Path: path}
+	}
+	sort.Slice(paths, func(i, j int) bool { return paths[i].Path < paths[j].Path })
+
+	return paths
+}
+
+func (db *DB) RetrieveCategories(ctx context.Context) ([]*Category, error) {
+	rows, err := db.db.QueryContext(
+		ctx,
+		`SELECT id, name, parent_id, COALESCE(color, ''), COALESCE(icon, '')
+		 FROM categories
+		 ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var categories []*Category
+	for rows.Next() {
+		c := new(Category)
+		if err := rows.Scan(&c.Id, &c.Name, &c.ParentId, &c.Color, &c.Icon); err != nil {
+			return nil, err
+		}
+		categories = append(categories, c)
+	}
+
+	return categories, rows.Err()
+}
+
+// SaveCategory creates c if it has no id, otherwise updates it. The id of a
+// new category is set on c.
+func (db *DB) SaveCategory(ctx context.Context, c *Category) error {
+	c.Name = strings.TrimSpace(c.Name)
+	if c.Name == "" {
+		return errCategoryName
+	}
+
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if c.ParentId != nil {
+		// Walk up from the new parent to make sure c isn't one of its ancestors
+		for id := *c.ParentId; ; {
+			if c.Id != 0 && id == c.Id {
+				return errCategoryCycle
+			}
+			var parent sql.NullInt64
+			err := tx.QueryRowContext(ctx, `SELECT parent_id FROM categories WHERE id=$1`, id).Scan(&parent)
+			if err == sql.ErrNoRows {
+				return errUnknownCategory
+			}
+			if err != nil {
+				return err
+			}
+			if !parent.Valid {
+				break
+			}
+			id = int(parent.Int64)
+		}
+	}
+
+	if c.Id == 0 {
+		res, err := tx.ExecContext(
+			ctx,
+			`INSERT INTO categories (name, parent_id, color, icon)
+			 VALUES ($1, $2, NULLIF($3, ''), NULLIF($4, ''))`, c.Name, c.ParentId, c.Color, c.Icon)
+		if err != nil {
+			return err
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		c.Id = int(id)
+	} else {
+		res, err := tx.ExecContext(
+			ctx,
+			`UPDATE categories
+			 SET name=$1, parent_id=$2, color=NULLIF($3, ''), icon=NULLIF($4, '')
+			 WHERE id=$5`, c.Name, c.ParentId, c.Color, c.Icon, c.Id)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return errUnknownCategory
+		}
+	}
+
+	return tx.Commit()
+}
+
+// DeleteCategory removes a category that has no subcategories, along with its
+// mappings. Transactions overridden to it go back to their mapped category,
+// rules stop setting it and its budget is removed.
+func (db *DB) DeleteCategory(ctx context.Context, id int) error {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var children int
+	err = tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM categories WHERE parent_id=$1`, id).Scan(&children)
+	if err != nil {
+		return err
+	}
+	if children > 0 {
+		return errCategoryHasChild
+	}
+
+	if _, err = tx.ExecContext(ctx, `DELETE FROM category_mappings WHERE category_id=$1`, id); err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, `UPDATE transaction_overrides SET category_id=NULL WHERE category_id=$1`, id); err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, `DELETE FROM transaction_overrides WHERE category_id IS NULL AND kind IS NULL`); err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, `UPDATE rules SET set_category_id=NULL WHERE set_category_id=$1`, id); err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, `UPDATE rule_results SET category_id=NULL WHERE category_id=$1`, id); err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, `UPDATE transaction_splits SET category_id=NULL WHERE category_id=$1`, id); err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, `DELETE FROM budgets WHERE category_id=$1`, id); err != nil {
+		return err
+	}
+	res, err := tx.ExecContext(ctx, `DELETE FROM categories WHERE id=$1`, id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errUnknownCategory
+	}
+
+	return tx.Commit()
+}
+
+func (db *DB) RetrieveCategoryMappings(ctx context.Context) ([]*CategoryMapping, error) {
+	rows, err := db.db.QueryContext(
+		ctx,
+		`SELECT plaid_category, category_id
+		 FROM category_mappings
+		 ORDER BY plaid_category`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var mappings []*CategoryMapping
+	for rows.Next() {
+		m := new(CategoryMapping)
+		if err := rows.Scan(&m.PlaidCategory, &m.CategoryId); err != nil {
+			return nil, err
+		}
+		mappings = append(mappings, m)
+	}
+
+	return mappings, rows.Err()
+}
+
+// SetCategoryMapping maps a Plaid category to categoryId, or removes the
+// mapping if categoryId is 0.
+func (db *DB) SetCategoryMapping(ctx context.Context, plaidCategory string, categoryId int) error {
+	if plaidCategory == "" {
+		return errMissingPlaidCategory
+	}
+	if categoryId == 0 {
+		_, err := db.db.ExecContext(ctx, `DELETE FROM category_mappings WHERE plaid_category=$1`, plaidCategory)
+		return err
+	}
+	if err := categoryExists(ctx, db.db, categoryId); err != nil {
+		return err
+	}
+
+	_, err := db.db.ExecContext(
+		ctx,
+		`INSERT INTO category_mappings (plaid_category, category_id)
+		 VALUES ($1, $2)
+		 ON CONFLICT (plaid_category) DO UPDATE SET category_id=excluded.category_id`, plaidCategory, categoryId)
+	return err
+}
+
+// SetTransactionCategory overrides the category of a transaction, or clears
+// the override if categoryId is 0.
+func (db *DB) SetTransactionCategory(ctx context.Context, plaidTransactionId string, categoryId int) error {
+	if categoryId == 0 {
+		return clearOverride(ctx, db.db, "category_id", plaidTransactionId)
+	}
+	if err := categoryExists(ctx, db.db, categoryId); err != nil {
+		return err
+	}
+
+	var n int
+	err := db.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM transactions WHERE plaid_transaction_id=$1`, plaidTransactionId).Scan(&n)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errUnknownTransaction
+	}
+
+	_, err = db.db.ExecContext(
+		ctx,
+		`INSERT INTO transaction_overrides (plaid_transaction_id, category_id)
+		 VALUES ($1, $2)
+		 ON CONFLICT (plaid_transaction_id) DO UPDATE SET category_id=excluded.category_id, updated_at=CURRENT_TIMESTAMP`,
+		plaidTransactionId, categoryId)
+	return err
+}
+
+// clearOverride clears one column of a transaction's override, removing the
+// override once nothing is left in it
+func clearOverride(ctx context.Context, ex execer, column, plaidTransactionId string) error {
+	_, err := ex.ExecContext(ctx, `UPDATE transaction_overrides SET `+column+`=NULL WHERE plaid_transaction_id=$1`, plaidTransactionId)
+	if err != nil {
+		return err
+	}
+	_, err = ex.ExecContext(
+		ctx,
+		`DELETE FROM transaction_overrides
+		 WHERE plaid_transaction_id=$1 AND category_id IS NULL AND kind IS NULL`, plaidTransactionId)
+	return err
+}
+
+func categoryExists(ctx context.Context, db *sql.DB, id int) error {
+	var n int
+	if err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM categories WHERE id=$1`, id).Scan(&n); err != nil {
+		return err
+	}
+	if n == 0 {
+		return errUnknownCategory
+	}
+
+	return nil
+}
+
+// statusForCategoryError maps errors from changing categories to HTTP statuses
+func statusForCategoryError(err error) int {
+	var serr sqlite3.Error
+	switch {
+	case errors.Is(err, errUnknownCategory), errors.Is(err, errUnknownTransaction):
+		return http.StatusNotFound
+	case errors.Is(err, errCategoryName), errors.Is(err, errMissingPlaidCategory):
+		return http.StatusBadRequest
+	case errors.Is(err, errCategoryHasChild), errors.Is(err, errCategoryCycle):
+		return http.StatusConflict
+	case errors.As(err, &serr) && serr.ExtendedCode == sqlite3.ErrConstraintUnique:
+		// A sibling already has the name
+		return http.StatusConflict
+	}
+
+	return http.StatusInternalServerError
+}
+
+// categories lists categories on GET, and creates or updates one on POST
+func (srv *Server) categories() http.HandlerFunc {
+	type response struct {
+		ErrorMsg   string      `json:",omitempty"`
+		Categories []*Category `json:"categories,omitempty"`
+		Category   *Category   `json:"category,omitempty"`
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		var resp response
+
+		switch req.Method {
+		case http.MethodGet:
+			categories, err := srv.db.RetrieveCategories(req.Context())
+			if err != nil {
+				resp.ErrorMsg = err.Error()
+				returnJSON(w, http.StatusInternalServerError, resp)
+				return
+			}
+			resp.Categories = categories
+			if resp.Categories == nil {
+				resp.Categories = []*Category{}
+			}
+		case http.MethodPost:
+			c := new(Category)
+			if err := json.NewDecoder(req.Body).Decode(c); err != nil {
+				resp.ErrorMsg = err.Error()
+				returnJSON(w, http.StatusBadRequest, resp)
+				return
+			}
+			if err := srv.db.SaveCategory(req.Context(), c); err != nil {
+				resp.ErrorMsg = err.Error()
+				returnJSON(w, statusForCategoryError(err), resp)
+				return
+			}
+			resp.Category = c
+		default:
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+
+		returnJSON(w, http.StatusOK, resp)
+	}
+}
+
+func (srv *Server) deleteCategory() http.HandlerFunc {
+	type payload struct {
+		Id int `json:"id"`
+	}
+
+	type response struct {
+		ErrorMsg string `json:",omitempty"`
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+
+		var resp response
+
+		pay := payload{}
+		if err := json.NewDecoder(req.Body).Decode(&pay); err != nil {
+			resp.ErrorMsg = err.Error()
+			returnJSON(w, http.StatusBadRequest, resp)
+			return
+		}
+		if err := srv.db.DeleteCategory(req.Context(), pay.Id); err != nil {
+			resp.ErrorMsg = err.Error()
+			returnJSON(w, statusForCategoryError(err), resp)
+			return
+		}
+
+		returnJSON(w, http.StatusOK, resp)
+	}
+}
+
+// categoryMappings lists the Plaid category mappings on GET, and sets one on
+// POST. A category_id of 0 removes the mapping.
+func (srv *Server) categoryMappings() http.HandlerFunc {
+	type response struct {
+		ErrorMsg string             `json:",omitempty"`
+		Mappings []*CategoryMapping `json:"mappings,omitempty"`
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		var resp response
+
+		switch req.Method {
+		case http.MethodGet:
+			mappings, err := srv.db.RetrieveCategoryMappings(req.Context())
+			if err != nil {
+				resp.ErrorMsg = err.Error()
+				returnJSON(w, http.StatusInternalServerError, resp)
+				return
+			}
+			resp.Mappings = mappings
+			if resp.Mappings == nil {
+				resp.Mappings = []*CategoryMapping{}
+			}
+		case http.MethodPost:
+			m := CategoryMapping{}
+			if err := json.NewDecoder(req.Body).Decode(&m); err != nil {
+				resp.ErrorMsg = err.Error()
+				returnJSON(w, http.StatusBadRequest, resp)
+				return
+			}
+			if err := srv.db.SetCategoryMapping(req.Context(), m.PlaidCategory, m.CategoryId); err != nil {
+				resp.ErrorMsg = err.Error()
+				returnJSON(w, statusForCategoryError(err), resp)
+				return
+			}
+		default:
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+
+		returnJSON(w, http.StatusOK, resp)
+	}
+}
+
+// setTransactionCategory overrides the category of one transaction. A
+// category_id of 0 clears the override.
+func (srv *Server) setTransactionCategory() http.HandlerFunc {
+	type payload struct {
+		TransactionId string `json:"transaction_id"`
+		CategoryId    int    `json:"category_id"`
+	}
+
+	type response struct {
+		ErrorMsg string `json:",omitempty"`
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+
+		var resp response
+
+		pay := payload{}
+		if err := json.NewDecoder(req.Body).Decode(&pay); err != nil {
+			resp.ErrorMsg = err.Error()
+			returnJSON(w, http.StatusBadRequest, resp)
+			return
+		}
+		if err := srv.db.SetTransactionCategory(req.Context(), pay.TransactionId, pay.CategoryId); err != nil {
+			resp.ErrorMsg = err.Error()
+			returnJSON(w, statusForCategoryError(err), resp)
+			return
+		}
+
+		returnJSON(w, http.StatusOK, resp)
+	}
+}
@@ -0,0 +1,95 @@
+package expenses
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/plaid/plaid-go/v12/plaid"
+)
+
+func TestTransactionCategories(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+
+	added := []plaid.Transaction{
+		testTransaction("t1", "a1", "2023-06-01", "Safeway", 20),
+		testTransaction("t2", "a1", "2023-06-02", "Safeway", 30),
+	}
+	if _, err := db.UpdatePlaidTransactions(ctx, added, nil, nil, "item1", "c1"); err != nil {
+		t.Fatal(err)
+	}
+
+	categoryOf := func(f TransactionFilter) map[string]string {
+		t.Helper()
+		txns, err := db.QueryTransactions(ctx, f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make(map[string]string)
+		for _, txn := range txns {
+			got[txn.PlaidTransactionId] = txn.CategoryName
+		}
+		return got
+	}
+
+	// The seeded mapping of the primary Plaid category applies
+	if got := categoryOf(TransactionFilter{}); got["t1"] != "Food & Drink" {
+		t.Errorf("got category %q for t1, want Food & Drink", got["t1"])
+	}
+
+	// A detailed mapping wins over the primary one
+	var food *Category
+	categories, err := db.RetrieveCategories(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range categories {
+		if c.Name == "Food & Drink" {
+			food = c
+		}
+	}
+	groceries := &Category{Name: "Groceries", ParentId: &food.Id}
+	if err := db.SaveCategory(ctx, groceries); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetCategoryMapping(ctx, "FOOD_AND_DRINK_GROCERIES", groceries.Id); err != nil {
+		t.Fatal(err)
+	}
+	if got := categoryOf(TransactionFilter{}); got["t1"] != "Groceries" {
+		t.Errorf("got category %q for t1, want Groceries", got["t1"])
+	}
+
+	// An override wins over any mapping
+	household := &Category{Name: "Household"}
+	if err := db.SaveCategory(ctx, household); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetTransactionCategory(ctx, "t2", household.Id); err != nil {
+		t.Fatal(err)
+	}
+	if got := categoryOf(TransactionFilter{}); got["t2"] != "Household" {
+		t.Errorf("got category %q for t2, want Household", got["t2"])
+	}
+
+	// Filtering by a parent includes its subcategories
+	if got := categoryOf(TransactionFilter{CategoryId: &food.Id}); len(got) != 1 || got["t1"] != "Groceries" {
+		t.Errorf("filtered by Food & Drink to %v, want only t1", got)
+	}
+
+	food.ParentId = &groceries.Id
+	if err := db.SaveCategory(ctx, food); !errors.Is(err, errCategoryCycle) {
+		t.Errorf("got %v moving a category under its child, want %v", err, errCategoryCycle)
+	}
+	if err := db.DeleteCategory(ctx, food.Id); !errors.Is(err, errCategoryHasChild) {
+		t.Errorf("got %v deleting a category with children, want %v", err, errCategoryHasChild)
+	}
+
+	// Deleting the override's category reverts to the mapping
+	if err := db.DeleteCategory(ctx, household.Id); err != nil {
+		t.Fatal(err)
+	}
+	if got := categoryOf(TransactionFilter{}); got["t2"] != "Groceries" {
+		t.Errorf("got category %q for t2, want Groceries", got["t2"])
+	}
+}
@@ -1,8 +1,15 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
+	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	expenses "github.com/chriskillpack/expense-tracker"
@@ -25,11 +32,9 @@ func envToPlaidEnv(env string) plaid.Environment {
 	return ""
 }
 
-func main() {
-	flag.Parse()
-
-	appConfig := expenses.AppConfig{}
-	_, err := toml.DecodeFile(*configFile, &appConfig)
+func loadConfig() *expenses.AppConfig {
+	appConfig := &expenses.AppConfig{}
+	_, err := toml.DecodeFile(*configFile, appConfig)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -46,6 +51,53 @@ func main() {
 		log.Fatal(err)
 	}
 
+	return appConfig
+}
+
+func openDB(appConfig *expenses.AppConfig) *expenses.DB {
+	tokens, err := appConfig.TokenCipher()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Print("Opening DB")
+	db, err := expenses.NewDB(appConfig.DbFile, appConfig.DbPassphrase)
+	if err != nil {
+		log.Fatal(err)
+	}
+	db.SetTokenCipher(tokens)
+
+	return db
+}
+
+func main() {
+	flag.Parse()
+
+	appConfig := loadConfig()
+
+	switch cmd := flag.Arg(0); cmd {
+	case "", "serve":
+		serve(appConfig)
+	case "rotate-key":
+		rotateKey(appConfig, flag.Args()[1:])
+	case "encrypt-db":
+		encryptDB(appConfig, flag.Args()[1:])
+	case "migrate":
+		migrate(appConfig, flag.Args()[1:])
+	case "rebuild-transactions":
+		rebuildTransactions(appConfig)
+	case "apply-rules":
+		applyRules(appConfig, flag.Args()[1:])
+	case "match-transfers":
+		matchTransfers(appConfig)
+	case "remove-item":
+		removeItem(appConfig, flag.Args()[1:])
+	default:
+		log.Fatalf("Unknown command %q", cmd)
+	}
+}
+
+func newPlaidClient(appConfig *expenses.AppConfig) *plaid.APIClient {
 	log.Printf("Environment %s\n", appConfig.Environment)
 	penv := envToPlaidEnv(appConfig.Environment)
 	if penv == "" {
@@ -57,20 +109,252 @@ func main() {
 	config.AddDefaultHeader("PLAID-CLIENT-ID", string(appConfig.PlaidClientId))
 	config.AddDefaultHeader("PLAID-SECRET", string(appConfig.PlaidClientSecret))
 
-	log.Print("Opening DB")
-	db, err := expenses.NewDB(appConfig.DbFile)
+	return plaid.NewAPIClient(config)
+}
+
+func serve(appConfig *expenses.AppConfig) {
+	client := newPlaidClient(appConfig)
+
+	db := openDB(appConfig)
+	defer db.Close()
+
+	srv := expenses.NewServer(client, db, appConfig)
+
+	// Shut down cleanly on SIGINT or SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		<-ctx.Done()
+		log.Print("Server stopping")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			log.Print(err)
+		}
+	}()
+
+	// Start up the HTTPS server
+	log.Print("Server starting")
+	if err := srv.Start(); err != nil {
+		log.Fatal(err)
+	}
+
+	// Start returns as soon as the listener closes, wait for in-flight
+	// requests to drain before the database is closed
+	<-done
+}
+
+// rotateKey re-encrypts all stored access tokens with a new key. Once it
+// completes access_token_key must be updated to the new key.
+func rotateKey(appConfig *expenses.AppConfig, args []string) {
+	fs := flag.NewFlagSet("rotate-key", flag.ExitOnError)
+	newKeyVal := fs.String("new-key", "!NEW_ACCESS_TOKEN_KEY", "New base64 encoded access token key, '!' prefix reads it from an env var")
+	fs.Parse(args)
+
+	newKeyStr, err := expenses.Resolve(*newKeyVal)
+	if err != nil {
+		log.Fatal(err)
+	}
+	newKey, err := expenses.ParseTokenKey(newKeyStr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	newTokens, err := expenses.NewTokenCipher(newKey)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	srv := expenses.NewServer(
-		plaid.NewAPIClient(config),
-		db,
-		appConfig.ServerPort,
-		appConfig.TLSCertFile,
-		appConfig.TLSKeyFile)
+	db := openDB(appConfig)
+	defer db.Close()
 
-	// Start up the HTTPS server
-	log.Print("Server starting")
-	srv.Start()
+	n, err := db.RotateTokenKey(context.Background(), newTokens)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Re-encrypted %d access tokens, update access_token_key to the new key", n)
+}
+
+// encryptDB converts the plaintext database in db_file into a SQLCipher
+// encrypted copy keyed with db_passphrase, then verifies every table made it
+// across.
+func encryptDB(appConfig *expenses.AppConfig, args []string) {
+	fs := flag.NewFlagSet("encrypt-db", flag.ExitOnError)
+	out := fs.String("out", "", "Path of the encrypted database to create")
+	fs.Parse(args)
+
+	if *out == "" {
+		log.Fatal("-out is required")
+	}
+	if appConfig.DbPassphrase == "" {
+		log.Fatal("db_passphrase must be set to encrypt the database")
+	}
+	if _, err := os.Stat(*out); err == nil {
+		log.Fatalf("%s already exists", *out)
+	}
+
+	ctx := context.Background()
+
+	// Open without migrating, the export must not write to its source
+	src, err := expenses.OpenDB(appConfig.DbFile, "")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer src.Close()
+
+	want, err := src.TableRowCounts(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err = src.ExportEncrypted(ctx, *out, appConfig.DbPassphrase); err != nil {
+		log.Fatal(err)
+	}
+
+	dst, err := expenses.OpenDB(*out, appConfig.DbPassphrase)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer dst.Close()
+
+	got, err := dst.TableRowCounts(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err = expenses.CompareRowCounts(want, got); err != nil {
+		log.Fatal(err)
+	}
+
+	for table, n := range got {
+		log.Printf("%s: %d rows", table, n)
+	}
+	log.Printf("Encrypted database written to %s, point db_file at it", *out)
+}
+
+// migrate inspects and changes the schema version of the database.
+//
+//	expenses migrate status
+//	expenses migrate up [-to version]
+//	expenses migrate down [-steps n]
+func migrate(appConfig *expenses.AppConfig, args []string) {
+	if len(args) == 0 {
+		log.Fatal("usage: expenses migrate status|up|down")
+	}
+
+	fs := flag.NewFlagSet("migrate "+args[0], flag.ExitOnError)
+	to := fs.Int("to", 0, "Version to migrate up to, 0 for the latest")
+	steps := fs.Int("steps", 1, "Number of migrations to revert")
+	fs.Parse(args[1:])
+
+	db, err := expenses.OpenDB(appConfig.DbFile, appConfig.DbPassphrase)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+
+	var done []expenses.Migration
+	switch args[0] {
+	case "status":
+		status, err := db.MigrationStatus(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, s := range status {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = "applied " + s.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%04d %-40s %s\n", s.Version, s.Name, applied)
+		}
+		return
+	case "up":
+		done, err = db.MigrateUp(ctx, *to)
+	case "down":
+		done, err = db.MigrateDown(ctx, *steps)
+	default:
+		log.Fatalf("Unknown migrate command %q", args[0])
+	}
+
+	for _, m := range done {
+		log.Printf("Migrated %s %04d %s", args[0], m.Version, m.Name)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(done) == 0 {
+		log.Print("Nothing to migrate")
+	}
+}
+
+// rebuildTransactions regenerates the normalized transactions table from the
+// raw Plaid transactions.
+func rebuildTransactions(appConfig *expenses.AppConfig) {
+	db := openDB(appConfig)
+	defer db.Close()
+
+	n, err := db.RebuildTransactions(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Rebuilt %d transactions", n)
+}
+
+// applyRules reruns the categorization rules over every transaction
+func applyRules(appConfig *expenses.AppConfig, args []string) {
+	fs := flag.NewFlagSet("apply-rules", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "List the changes without making them")
+	fs.Parse(args)
+
+	db := openDB(appConfig)
+	defer db.Close()
+
+	changes, err := db.ApplyRules(context.Background(), *dryRun)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, c := range changes {
+		before, _ := json.Marshal(c.Before)
+		after, _ := json.Marshal(c.After)
+		fmt.Printf("%s %s %.2f %q: %s -> %s\n", c.TransactionId, c.Date, c.Amount, c.Name, before, after)
+	}
+	if *dryRun {
+		log.Printf("%d transactions would change", len(changes))
+	} else {
+		log.Printf("Changed %d transactions", len(changes))
+	}
+}
+
+// matchTransfers pairs up the legs of transfers between linked accounts
+func matchTransfers(appConfig *expenses.AppConfig) {
+	db := openDB(appConfig)
+	defer db.Close()
+
+	matches, err := db.MatchTransfers(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Matched %d transfers, %d possible transfers to review", matches.Matched, matches.Review)
+}
+
+// removeItem unlinks a bank connection from Plaid and removes it from the DB
+func removeItem(appConfig *expenses.AppConfig, args []string) {
+	fs := flag.NewFlagSet("remove-item", flag.ExitOnError)
+	itemId := fs.String("item", "", "Plaid item id of the item to remove")
+	retain := fs.Bool("retain", appConfig.RetainHistoryOnRemove, "Keep the item's accounts and transactions")
+	fs.Parse(args)
+
+	if *itemId == "" {
+		log.Fatal("-item is required")
+	}
+
+	client := newPlaidClient(appConfig)
+	db := openDB(appConfig)
+	defer db.Close()
+
+	if err := expenses.RemoveItem(context.Background(), client, db, *itemId, *retain); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Removed item %s (history retained: %t)", *itemId, *retain)
 }
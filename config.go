@@ -3,11 +3,14 @@ package expenses
 import (
 	"fmt"
 	"os"
+	"time"
 )
 
 // AppConfig holds application config parsed from TOML config file
 type AppConfig struct {
+	AccessTokenKey    string `toml:"access_token_key"`
 	DbFile            string `toml:"db_file"`
+	DbPassphrase      string `toml:"db_passphrase"`
 	Environment       string `toml:"environment"`
 	EnvFile           string `toml:"env_file"`
 	PlaidClientId     string `toml:"plaid_client_id"`
@@ -15,9 +18,24 @@ type AppConfig struct {
 	ServerPort        int    `toml:"server_port"`
 	TLSCertFile       string `toml:"https_cert_file"`
 	TLSKeyFile        string `toml:"https_key_file"`
+	WebhookURL        string `toml:"webhook_url"`
+
+	// Background transaction syncing, disabled if SyncInterval is 0
+	SyncInterval      time.Duration            `toml:"sync_interval"`
+	SyncJitter        time.Duration            `toml:"sync_jitter"`
+	SyncItemIntervals map[string]time.Duration `toml:"sync_item_intervals"` // keyed by Plaid item id
+
+	// Keep an item's accounts and transactions when it is removed
+	RetainHistoryOnRemove bool `toml:"retain_history_on_remove"`
+
+	// Also ask Plaid for recurring transactions, which needs the Recurring
+	// Transactions product
+	PlaidRecurring bool `toml:"plaid_recurring"`
 }
 
-func resolve(wtf string) (string, error) {
+// Resolve returns the value of a config entry. Values prefixed with '!' name
+// an environment variable to read the value from.
+func Resolve(wtf string) (string, error) {
 	if len(wtf) == 0 {
 		return "", nil
 	}
@@ -30,21 +48,48 @@ func resolve(wtf string) (string, error) {
 			return "", fmt.Errorf("env var %s undefined or empty", env)
 		}
 	}
-	return "", nil
+	return wtf, nil
 }
 
 func (c *AppConfig) ResolveEnvVars() error {
-	if pcid, err := resolve(string(c.PlaidClientId)); err != nil {
+	if pcid, err := Resolve(string(c.PlaidClientId)); err != nil {
 		return err
 	} else {
 		c.PlaidClientId = pcid
 	}
 
-	if pcs, err := resolve(string(c.PlaidClientSecret)); err != nil {
+	if pcs, err := Resolve(string(c.PlaidClientSecret)); err != nil {
 		return err
 	} else {
 		c.PlaidClientSecret = pcs
 	}
 
+	if dbp, err := Resolve(c.DbPassphrase); err != nil {
+		return err
+	} else {
+		c.DbPassphrase = dbp
+	}
+
+	if atk, err := Resolve(c.AccessTokenKey); err != nil {
+		return err
+	} else {
+		c.AccessTokenKey = atk
+	}
+
 	return nil
 }
+
+// TokenCipher returns the cipher used to encrypt Plaid access tokens, or nil
+// if no access_token_key is configured.
+func (c *AppConfig) TokenCipher() (*TokenCipher, error) {
+	if c.AccessTokenKey == "" {
+		return nil, nil
+	}
+
+	key, err := ParseTokenKey(c.AccessTokenKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewTokenCipher(key)
+}
@@ -0,0 +1,143 @@
+package expenses
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Prefix identifying an encrypted access token. Values without it are legacy
+// plaintext tokens.
+const encryptedTokenPrefix = "enc:v1:"
+
+var errNoTokenCipher = errors.New("access token is encrypted but no access_token_key is configured")
+
+// TokenCipher encrypts Plaid access tokens at rest using envelope encryption.
+// Each token is sealed with its own random data key, and the data key is in
+// turn sealed with the key encryption key (KEK) from the config.
+type TokenCipher struct {
+	kek cipher.AEAD
+}
+
+// ParseTokenKey decodes a base64 encoded 256-bit key.
+func ParseTokenKey(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("access token key is not valid base64: %w", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("access token key must be 32 bytes, got %d", len(key))
+	}
+
+	return key, nil
+}
+
+func NewTokenCipher(key []byte) (*TokenCipher, error) {
+	kek, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TokenCipher{kek: kek}, nil
+}
+
+// Encrypt returns the encrypted form of token, suitable for storing in the DB.
+// A nil TokenCipher stores tokens as plaintext.
+func (tc *TokenCipher) Encrypt(token string) (string, error) {
+	if tc == nil {
+		return token, nil
+	}
+
+	dek := make([]byte, 32)
+	if _, err := rand.Read(dek); err != nil {
+		return "", err
+	}
+	dekAEAD, err := newGCM(dek)
+	if err != nil {
+		return "", err
+	}
+
+	wrappedKey, err := seal(tc.kek, dek)
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := seal(dekAEAD, []byte(token))
+	if err != nil {
+		return "", err
+	}
+
+	return encryptedTokenPrefix +
+		base64.StdEncoding.EncodeToString(wrappedKey) + ":" +
+		base64.StdEncoding.EncodeToString(ciphertext), nil
+}
+
+// Decrypt reverses Encrypt. Plaintext tokens are returned unchanged so that
+// databases created before encryption was enabled keep working.
+func (tc *TokenCipher) Decrypt(stored string) (string, error) {
+	if !strings.HasPrefix(stored, encryptedTokenPrefix) {
+		return stored, nil
+	}
+	if tc == nil {
+		return "", errNoTokenCipher
+	}
+
+	wrappedKey64, ciphertext64, ok := strings.Cut(stored[len(encryptedTokenPrefix):], ":")
+	if !ok {
+		return "", errors.New("malformed encrypted access token")
+	}
+	wrappedKey, err := base64.StdEncoding.DecodeString(wrappedKey64)
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(ciphertext64)
+	if err != nil {
+		return "", err
+	}
+
+	dek, err := open(tc.kek, wrappedKey)
+	if err != nil {
+		return "", fmt.Errorf("unwrapping access token key: %w", err)
+	}
+	dekAEAD, err := newGCM(dek)
+	if err != nil {
+		return "", err
+	}
+	token, err := open(dekAEAD, ciphertext)
+	if err != nil {
+		return "", fmt.Errorf("decrypting access token: %w", err)
+	}
+
+	return string(token), nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plaintext and prepends the random nonce to the result
+func seal(aead cipher.AEAD, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func open(aead cipher.AEAD, data []byte) ([]byte, error) {
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := data[:aead.NonceSize()], data[aead.NonceSize():]
+
+	return aead.Open(nil, nonce, ciphertext, nil)
+}
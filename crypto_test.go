@@ -0,0 +1,40 @@
+package expenses
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestTokenCipherRoundTrip(t *testing.T) {
+	tc, err := NewTokenCipher(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	enc, err := tc.Encrypt("access-sandbox-1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(enc, encryptedTokenPrefix) || strings.Contains(enc, "access-sandbox") {
+		t.Fatalf("token not encrypted: %q", enc)
+	}
+
+	dec, err := tc.Decrypt(enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dec != "access-sandbox-1234" {
+		t.Errorf("got %q, want %q", dec, "access-sandbox-1234")
+	}
+
+	// Legacy plaintext tokens pass through
+	if dec, _ := tc.Decrypt("access-sandbox-5678"); dec != "access-sandbox-5678" {
+		t.Errorf("plaintext token changed to %q", dec)
+	}
+
+	other, _ := NewTokenCipher(bytes.Repeat([]byte{2}, 32))
+	if _, err := other.Decrypt(enc); err == nil {
+		t.Error("expected decryption with the wrong key to fail")
+	}
+}
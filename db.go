@@ -3,8 +3,8 @@ package expenses
 import (
 	"context"
 	"database/sql"
-	_ "embed"
 	"encoding/json"
+	"fmt"
 	"strconv"
 	"sync"
 	"time"
@@ -13,29 +13,76 @@ import (
 	"github.com/plaid/plaid-go/v12/plaid"
 )
 
-//go:embed schema.sql
-var sqlSchema string
-
 type DB struct {
-	mu sync.Mutex
-	db *sql.DB
+	mu     sync.Mutex
+	db     *sql.DB
+	tokens *TokenCipher
 }
 
-type Account struct {
-	Id             int
-	PlaidAccountId string
-	AccountMask    string
-	Type           string
-	Subtype        string
+// execer is satisfied by both *sql.DB and *sql.Tx
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
 }
 
-type Item struct {
+// queryer is satisfied by both *sql.DB and *sql.Tx
+type queryer interface {
+	execer
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+type Account struct {
 	Id                 int
-	AccessToken        string
+	PlaidAccountId     string
 	PlaidItemId        string
 	PlaidInstitutionId string
+	AccountMask        string
+	Type               string
+	Subtype            string
+	Name               string // display name
+	OfficialName       string
+	IsoCurrencyCode    string
+	CurrentBalance     *float64
+	AvailableBalance   *float64
+	BalanceUpdatedAt   *time.Time
+}
+
+type Item struct {
+	Id                  int
+	AccessToken         string
+	PlaidItemId         string
+	PlaidInstitutionId  string
+	Status              string
+	LastSyncedAt        *time.Time
+	LastErrorCode       string
+	LastErrorMessage    string
+	ConsecutiveFailures int
 }
 
+// NeedsAttention reports whether the item's bank connection needs fixing
+func (i *Item) NeedsAttention() bool {
+	return i.Status != ItemStatusOK
+}
+
+// Columns read by scanItems
+const itemColumns = `id,
+		plaid_access_token,
+		plaid_item_id,
+		plaid_institution_id,
+		status,
+		last_synced_at,
+		COALESCE(last_error_code, ''),
+		COALESCE(last_error_message, ''),
+		consecutive_failures`
+
+// Item statuses, as reported by Plaid webhooks
+const (
+	ItemStatusOK                = "ok"
+	ItemStatusLoginRequired     = "login_required"
+	ItemStatusPendingExpiration = "pending_expiration"
+	ItemStatusError             = "error"
+)
+
 type Institution struct {
 	Id                 int
 	PlaidInstitutionId string
@@ -50,24 +97,50 @@ func (db *DB) Close() {
 	db.db.Close()
 }
 
-func NewDB(fname string) (*DB, error) {
-	db, err := sql.Open("sqlite3", fname)
+// NewDB opens the database in fname, creating it if necessary, and brings the
+// schema up to date. If passphrase is not empty the database is encrypted with
+// SQLCipher.
+func NewDB(fname, passphrase string) (*DB, error) {
+	db, err := OpenDB(fname, passphrase)
 	if err != nil {
 		return nil, err
 	}
 
-	if err := db.Ping(); err != nil {
+	if _, err := db.MigrateUp(context.Background(), 0); err != nil {
+		db.Close()
 		return nil, err
 	}
-	if _, err := db.Exec(sqlSchema); err != nil {
+
+	return db, nil
+}
+
+// OpenDB opens the database in fname without applying any migrations.
+func OpenDB(fname, passphrase string) (*DB, error) {
+	db, err := openSQLite(fname, passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.Ping(); err != nil {
 		return nil, err
 	}
 
 	return &DB{db: db}, nil
 }
 
+// SetTokenCipher enables encryption of Plaid access tokens. Without a cipher
+// tokens are stored as plaintext.
+func (db *DB) SetTokenCipher(tc *TokenCipher) {
+	db.tokens = tc
+}
+
 func (db *DB) CreateNewItem(ctx context.Context, id, access_token, institution_id string) error {
-	_, err := db.db.ExecContext(
+	access_token, err := db.tokens.Encrypt(access_token)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.db.ExecContext(
 		ctx,
 		`INSERT INTO items
 			(plaid_item_id,plaid_access_token,plaid_institution_id)
@@ -79,32 +152,53 @@ func (db *DB) CreateNewItem(ctx context.Context, id, access_token, institution_i
 func (db *DB) RetrieveItems(ctx context.Context) ([]*Item, error) {
 	rows, err := db.db.QueryContext(
 		ctx,
-		`SELECT id,
-				plaid_access_token,
-				plaid_item_id,
-				plaid_institution_id
-		 FROM items`)
+		`SELECT `+itemColumns+`
+		 FROM items
+		 WHERE removed_at IS NULL`)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	return scanItems(rows)
+	return db.scanItems(rows)
 }
 
-func (db *DB) CreateAccounts(ctx context.Context, accounts []Account, institutionId string) error {
+// CreateAccounts creates or updates the accounts belonging to an item. Balances
+// are only overwritten when the account has them.
+func (db *DB) CreateAccounts(ctx context.Context, accounts []Account, itemId, institutionId string) error {
 	txn, err := db.db.BeginTx(ctx, nil)
 	if err != nil {
-		return nil
+		return err
 	}
 	defer txn.Rollback()
 
 	for _, acct := range accounts {
+		var balanceUpdatedAt *time.Time
+		if acct.CurrentBalance != nil || acct.AvailableBalance != nil {
+			balanceUpdatedAt = acct.BalanceUpdatedAt
+		}
+
 		_, err := txn.ExecContext(
 			ctx,
-			`REPLACE INTO accounts
-				(plaid_account_id, plaid_institution_id, account_mask, type, subtype)
-			VALUES ($1, $2, $3, $4, $5)`, acct.PlaidAccountId, institutionId, acct.AccountMask, acct.Type, acct.Subtype)
+			`INSERT INTO accounts
+				(plaid_account_id, plaid_item_id, plaid_institution_id, account_mask, type, subtype,
+				 name, official_name, iso_currency_code, current_balance, available_balance, balance_updated_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+			ON CONFLICT (plaid_account_id) DO UPDATE SET
+				plaid_item_id=excluded.plaid_item_id,
+				plaid_institution_id=excluded.plaid_institution_id,
+				account_mask=excluded.account_mask,
+				type=excluded.type,
+				subtype=excluded.subtype,
+				name=COALESCE(NULLIF(excluded.name, ''), accounts.name),
+				official_name=COALESCE(NULLIF(excluded.official_name, ''), accounts.official_name),
+				iso_currency_code=COALESCE(NULLIF(excluded.iso_currency_code, ''), accounts.iso_currency_code),
+				current_balance=COALESCE(excluded.current_balance, accounts.current_balance),
+				available_balance=COALESCE(excluded.available_balance, accounts.available_balance),
+				balance_updated_at=COALESCE(excluded.balance_updated_at, accounts.balance_updated_at),
+				archived_at=NULL`,
+			acct.PlaidAccountId, itemId, institutionId, acct.AccountMask, acct.Type, acct.Subtype,
+			acct.Name, acct.OfficialName, acct.IsoCurrencyCode, acct.CurrentBalance, acct.AvailableBalance, balanceUpdatedAt)
 		if err != nil {
 			return err
 		}
@@ -117,27 +211,220 @@ func (db *DB) CreateAccounts(ctx context.Context, accounts []Account, institutio
 	return nil
 }
 
-func (db *DB) RetrieveItemsByPlaidInstitutionId(ctx context.Context, institutionId string) ([]*Item, error) {
+// RetrieveAccounts returns every account that hasn't been archived.
+func (db *DB) RetrieveAccounts(ctx context.Context) ([]*Account, error) {
 	rows, err := db.db.QueryContext(
 		ctx,
 		`SELECT id,
-				plaid_access_token,
-				plaid_item_id,
-				plaid_institution_id
-		 FROM items WHERE plaid_institution_id=$1`, institutionId)
+				plaid_account_id,
+				COALESCE(plaid_item_id, ''),
+				plaid_institution_id,
+				COALESCE(account_mask, ''),
+				COALESCE(type, ''),
+				COALESCE(subtype, ''),
+				COALESCE(name, ''),
+				COALESCE(official_name, ''),
+				COALESCE(iso_currency_code, ''),
+				current_balance,
+				available_balance,
+				balance_updated_at
+		 FROM accounts
+		 WHERE archived_at IS NULL
+		 ORDER BY plaid_institution_id, name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var accounts []*Account
+	for rows.Next() {
+		acct := new(Account)
+		err := rows.Scan(
+			&acct.Id, &acct.PlaidAccountId, &acct.PlaidItemId, &acct.PlaidInstitutionId, &acct.AccountMask,
+			&acct.Type, &acct.Subtype, &acct.Name, &acct.OfficialName, &acct.IsoCurrencyCode,
+			&acct.CurrentBalance, &acct.AvailableBalance, &acct.BalanceUpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, acct)
+	}
+
+	return accounts, rows.Err()
+}
+
+func (db *DB) RetrieveItemsByPlaidInstitutionId(ctx context.Context, institutionId string) ([]*Item, error) {
+	rows, err := db.db.QueryContext(
+		ctx,
+		`SELECT `+itemColumns+`
+		 FROM items WHERE plaid_institution_id=$1 AND removed_at IS NULL`, institutionId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return db.scanItems(rows)
+}
+
+// RetrieveItemByPlaidItemId returns nil if there is no item with the id.
+func (db *DB) RetrieveItemByPlaidItemId(ctx context.Context, itemId string) (*Item, error) {
+	rows, err := db.db.QueryContext(
+		ctx,
+		`SELECT `+itemColumns+`
+		 FROM items WHERE plaid_item_id=$1 AND removed_at IS NULL`, itemId)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	return scanItems(rows)
+	items, err := db.scanItems(rows)
+	if err != nil || len(items) == 0 {
+		return nil, err
+	}
+
+	return items[0], nil
+}
+
+func (db *DB) UpdateItemStatus(ctx context.Context, itemId, status string) error {
+	_, err := db.db.ExecContext(
+		ctx,
+		`UPDATE items
+			SET status=$1, updated_at=CURRENT_TIMESTAMP
+		 WHERE plaid_item_id=$2`, status, itemId)
+
+	return err
+}
+
+// RemoveItem deletes an item along with its cursor, accounts and transactions.
+// If retainHistory is true the item is archived instead: its access token and
+// cursor are discarded but its accounts and transactions are kept.
+func (db *DB) RemoveItem(ctx context.Context, itemId string, retainHistory bool) error {
+	txn, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer txn.Rollback()
+
+	if _, err = txn.ExecContext(ctx, `DELETE FROM cursors WHERE plaid_item_id=$1`, itemId); err != nil {
+		return err
+	}
+
+	if retainHistory {
+		now := time.Now().UTC()
+		_, err = txn.ExecContext(
+			ctx,
+			`UPDATE accounts
+				SET archived_at=$1
+			 WHERE plaid_item_id=$2`, now, itemId)
+		if err != nil {
+			return err
+		}
+
+		// The access token is useless once Plaid has removed the item, but
+		// the column is unique and not null.
+		_, err = txn.ExecContext(
+			ctx,
+			`UPDATE items
+				SET removed_at=$1,
+					plaid_access_token='removed:'||plaid_item_id,
+					updated_at=CURRENT_TIMESTAMP
+			 WHERE plaid_item_id=$2`, now, itemId)
+		if err != nil {
+			return err
+		}
+	} else {
+		for _, query := range []string{
+			`DELETE FROM balance_snapshots
+			 WHERE plaid_account_id IN (SELECT plaid_account_id FROM accounts WHERE plaid_item_id=$1)`,
+			`DELETE FROM accounts WHERE plaid_item_id=$1`,
+			`DELETE FROM plaid_transaction_revisions
+			 WHERE plaid_transaction_id IN (SELECT plaid_transaction_id FROM plaid_transactions WHERE plaid_item_id=$1)`,
+			`DELETE FROM transaction_overrides
+			 WHERE plaid_transaction_id IN (SELECT plaid_transaction_id FROM transactions WHERE plaid_item_id=$1)`,
+			`DELETE FROM rule_results
+			 WHERE plaid_transaction_id IN (SELECT plaid_transaction_id FROM transactions WHERE plaid_item_id=$1)`,
+			`DELETE FROM transaction_tags
+			 WHERE plaid_transaction_id IN (SELECT plaid_transaction_id FROM transactions WHERE plaid_item_id=$1)`,
+			`DELETE FROM transaction_notes
+			 WHERE plaid_transaction_id IN (SELECT plaid_transaction_id FROM transactions WHERE plaid_item_id=$1)`,
+			`DELETE FROM transaction_splits
+			 WHERE plaid_transaction_id IN (SELECT plaid_transaction_id FROM transactions WHERE plaid_item_id=$1)`,
+			`DELETE FROM transfer_pairs
+			 WHERE out_transaction_id IN (SELECT plaid_transaction_id FROM transactions WHERE plaid_item_id=$1)
+				OR in_transaction_id IN (SELECT plaid_transaction_id FROM transactions WHERE plaid_item_id=$1)`,
+			`DELETE FROM transactions WHERE plaid_item_id=$1`,
+			`DELETE FROM plaid_transactions WHERE plaid_item_id=$1`,
+			`DELETE FROM items WHERE plaid_item_id=$1`,
+		} {
+			if _, err = txn.ExecContext(ctx, query, itemId); err != nil {
+				return err
+			}
+		}
+	}
+
+	return txn.Commit()
+}
+
+// RecordItemSyncSuccess marks the item healthy and clears any previous error.
+// A pending expiration is left alone, syncing keeps working until consent
+// actually expires.
+func (db *DB) RecordItemSyncSuccess(ctx context.Context, itemId string) error {
+	_, err := db.db.ExecContext(
+		ctx,
+		`UPDATE items
+			SET status=CASE WHEN status=$1 THEN status ELSE $2 END,
+				last_synced_at=$3,
+				last_error_code=NULL,
+				last_error_message=NULL,
+				consecutive_failures=0,
+				updated_at=CURRENT_TIMESTAMP
+		 WHERE plaid_item_id=$4`, ItemStatusPendingExpiration, ItemStatusOK, time.Now().UTC(), itemId)
+
+	return err
+}
+
+// ClearItemError marks the item healthy after the user repaired it, without
+// treating it as synced.
+func (db *DB) ClearItemError(ctx context.Context, itemId string) error {
+	_, err := db.db.ExecContext(
+		ctx,
+		`UPDATE items
+			SET status=$1,
+				last_error_code=NULL,
+				last_error_message=NULL,
+				consecutive_failures=0,
+				updated_at=CURRENT_TIMESTAMP
+		 WHERE plaid_item_id=$2`, ItemStatusOK, itemId)
+
+	return err
+}
+
+// RecordItemSyncFailure records a failed sync of the item. A Plaid error code
+// of ITEM_LOGIN_REQUIRED means the user needs to re-authenticate.
+func (db *DB) RecordItemSyncFailure(ctx context.Context, itemId, errorCode, errorMessage string) error {
+	status := ItemStatusError
+	if errorCode == "ITEM_LOGIN_REQUIRED" {
+		status = ItemStatusLoginRequired
+	}
+
+	_, err := db.db.ExecContext(
+		ctx,
+		`UPDATE items
+			SET status=$1,
+				last_error_code=$2,
+				last_error_message=$3,
+				consecutive_failures=consecutive_failures+1,
+				updated_at=CURRENT_TIMESTAMP
+		 WHERE plaid_item_id=$4`, status, errorCode, errorMessage, itemId)
+
+	return err
 }
 
 func (db *DB) UniqueInstitutionIds(ctx context.Context) ([]string, error) {
 	rows, err := db.db.QueryContext(
 		ctx,
 		`SELECT DISTINCT plaid_institution_id
-		 FROM items`)
+		 FROM items
+		 WHERE removed_at IS NULL`)
 	if err != nil {
 		return nil, err
 	}
@@ -179,6 +466,33 @@ func (db *DB) RetrieveInstitutionById(ctx context.Context, institutionId string)
 	return institution, err
 }
 
+func (db *DB) RetrieveInstitutions(ctx context.Context) ([]*Institution, error) {
+	rows, err := db.db.QueryContext(
+		ctx,
+		`SELECT id,
+				plaid_institution_id,
+				name,
+				COALESCE(logo, '')
+		 FROM institutions
+		 ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var institutions []*Institution
+	for rows.Next() {
+		institution := &Institution{}
+		err := rows.Scan(&institution.Id, &institution.PlaidInstitutionId, &institution.Name, &institution.Logo)
+		if err != nil {
+			return nil, err
+		}
+		institutions = append(institutions, institution)
+	}
+
+	return institutions, rows.Err()
+}
+
 func (db *DB) UpdateInstitution(ctx context.Context, institution *Institution) error {
 	if institution.Id == 0 {
 		// It's a new record, insert it
@@ -217,52 +531,23 @@ func (db *DB) GetItemCursorOrNil(ctx context.Context, item_id string) (string, e
 	return cursor, nil
 }
 
-func (db *DB) UpdatePlaidTransactions(ctx context.Context, added []plaid.Transaction, removed []plaid.RemovedTransaction, plaid_item_id, cursor string) (int64, error) {
-	// Insert into the DB in batches of 5
-	const batchSize = 5
-
+// UpdatePlaidTransactions stores the results of syncing an item's transactions
+// and advances its cursor. Added and modified transactions are upserted, any
+// version they replace is kept in plaid_transaction_revisions. Returns the
+// number of rows written for added transactions.
+func (db *DB) UpdatePlaidTransactions(ctx context.Context, added, modified []plaid.Transaction, removed []plaid.RemovedTransaction, plaid_item_id, cursor string) (int64, error) {
 	txn, err := db.db.BeginTx(ctx, nil)
 	if err != nil {
-		return 0, nil
+		return 0, err
 	}
 	defer txn.Rollback()
 
-	start := 0
-	var affected int64
-	for start < len(added) {
-		end := start + batchSize
-		if end > len(added) {
-			end = len(added)
-		}
-
-		queryString := "INSERT INTO plaid_transactions (plaid_transaction, plaid_transaction_id) VALUES"
-		params := make([]any, batchSize*2)
-		for idx, item := range added[start:end] {
-			queryString = queryString + " ($" + strconv.Itoa(idx*2+1) + ",$" + strconv.Itoa(idx*2+2) + "),"
-
-			jsontxn, err := json.Marshal(item)
-			if err != nil {
-				return 0, err
-			}
-
-			params[idx*2+0] = string(jsontxn)
-			params[idx*2+1] = item.GetTransactionId()
-		}
-		// Remove the trailing colon
-		queryString = queryString[0 : len(queryString)-1]
-
-		res, err := txn.ExecContext(ctx, queryString, params...)
-		if err != nil {
-			return 0, err
-		}
-		ra, err := res.RowsAffected()
-		if err != nil {
-			return 0, err
-		}
-
-		affected += ra
-
-		start = end
+	affected, err := upsertPlaidTransactions(ctx, txn, added, plaid_item_id)
+	if err != nil {
+		return 0, err
+	}
+	if _, err = upsertPlaidTransactions(ctx, txn, modified, plaid_item_id); err != nil {
+		return 0, err
 	}
 
 	// Go through and mark any removed transactions
@@ -279,6 +564,44 @@ func (db *DB) UpdatePlaidTransactions(ctx context.Context, added []plaid.Transac
 		}
 	}
 
+	// Bring the normalized transactions up to date
+	for _, item := range added {
+		if err = normalizeTransaction(ctx, txn, item.GetTransactionId()); err != nil {
+			return 0, err
+		}
+		if pendingId := item.GetPendingTransactionId(); pendingId != "" {
+			if err = carryOverAnnotations(ctx, txn, pendingId, item.GetTransactionId()); err != nil {
+				return 0, err
+			}
+		}
+	}
+	for _, item := range modified {
+		if err = normalizeTransaction(ctx, txn, item.GetTransactionId()); err != nil {
+			return 0, err
+		}
+	}
+	for _, rem := range removed {
+		if err = normalizeTransaction(ctx, txn, rem.GetTransactionId()); err != nil {
+			return 0, err
+		}
+	}
+
+	// Categorize and tag the new and changed transactions
+	rules, err := loadRules(ctx, txn)
+	if err != nil {
+		return 0, err
+	}
+	ids := make([]string, 0, len(added)+len(modified))
+	for _, item := range added {
+		ids = append(ids, item.GetTransactionId())
+	}
+	for _, item := range modified {
+		ids = append(ids, item.GetTransactionId())
+	}
+	if err = applyRulesTo(ctx, txn, rules, ids); err != nil {
+		return 0, err
+	}
+
 	// Finally update the cursor
 	_, err = txn.ExecContext(
 		ctx,
@@ -296,14 +619,139 @@ func (db *DB) UpdatePlaidTransactions(ctx context.Context, added []plaid.Transac
 	return affected, nil
 }
 
-func scanItems(rows *sql.Rows) ([]*Item, error) {
+// RotateTokenKey re-encrypts every stored access token with a new cipher.
+// Plaintext tokens are encrypted as part of the rotation.
+func (db *DB) RotateTokenKey(ctx context.Context, newTokens *TokenCipher) (int, error) {
+	txn, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer txn.Rollback()
+
+	rows, err := txn.QueryContext(ctx, `SELECT id, plaid_access_token FROM items WHERE removed_at IS NULL`)
+	if err != nil {
+		return 0, err
+	}
+	stored := make(map[int]string)
+	for rows.Next() {
+		var id int
+		var token string
+		if err := rows.Scan(&id, &token); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		stored[id] = token
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for id, token := range stored {
+		plain, err := db.tokens.Decrypt(token)
+		if err != nil {
+			return 0, fmt.Errorf("item %d: %w", id, err)
+		}
+		reencrypted, err := newTokens.Encrypt(plain)
+		if err != nil {
+			return 0, err
+		}
+
+		_, err = txn.ExecContext(
+			ctx,
+			`UPDATE items SET plaid_access_token=$1, updated_at=CURRENT_TIMESTAMP WHERE id=$2`, reencrypted, id)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if err = txn.Commit(); err != nil {
+		return 0, err
+	}
+	db.tokens = newTokens
+
+	return len(stored), nil
+}
+
+// upsertPlaidTransactions writes transactions to plaid_transactions, saving a
+// revision of any existing row whose contents change.
+func upsertPlaidTransactions(ctx context.Context, txn *sql.Tx, txns []plaid.Transaction, plaid_item_id string) (int64, error) {
+	// Insert into the DB in batches of 5
+	const batchSize = 5
+
+	start := 0
+	var affected int64
+	for start < len(txns) {
+		// A transaction can appear more than once in a sync. Each version goes
+		// in its own batch so that the ones it replaces are kept as revisions.
+		end := start
+		inBatch := make(map[string]bool)
+		for end < len(txns) && end-start < batchSize && !inBatch[txns[end].GetTransactionId()] {
+			inBatch[txns[end].GetTransactionId()] = true
+			end++
+		}
+
+		queryString := "INSERT INTO plaid_transactions (plaid_transaction, plaid_transaction_id, plaid_item_id) VALUES"
+		params := make([]any, (end-start)*3)
+		for idx, item := range txns[start:end] {
+			queryString = queryString + " ($" + strconv.Itoa(idx*3+1) + ",$" + strconv.Itoa(idx*3+2) + ",$" + strconv.Itoa(idx*3+3) + "),"
+
+			jsontxn, err := json.Marshal(item)
+			if err != nil {
+				return 0, err
+			}
+
+			_, err = txn.ExecContext(
+				ctx,
+				`INSERT INTO plaid_transaction_revisions (plaid_transaction_id, plaid_transaction, deleted_at)
+				 SELECT plaid_transaction_id, plaid_transaction, deleted_at
+				 FROM plaid_transactions
+				 WHERE plaid_transaction_id=$1 AND plaid_transaction<>$2`, item.GetTransactionId(), string(jsontxn))
+			if err != nil {
+				return 0, err
+			}
+
+			params[idx*3+0] = string(jsontxn)
+			params[idx*3+1] = item.GetTransactionId()
+			params[idx*3+2] = plaid_item_id
+		}
+		// Remove the trailing colon
+		queryString = queryString[0 : len(queryString)-1]
+		queryString += ` ON CONFLICT (plaid_transaction_id) DO UPDATE SET
+			plaid_transaction=excluded.plaid_transaction,
+			plaid_item_id=excluded.plaid_item_id,
+			deleted_at=NULL`
+
+		res, err := txn.ExecContext(ctx, queryString, params...)
+		if err != nil {
+			return 0, err
+		}
+		ra, err := res.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+
+		affected += ra
+
+		start = end
+	}
+
+	return affected, nil
+}
+
+func (db *DB) scanItems(rows *sql.Rows) ([]*Item, error) {
 	var items []*Item
 	for rows.Next() {
 		item := new(Item)
-		err := rows.Scan(&item.Id, &item.AccessToken, &item.PlaidItemId, &item.PlaidInstitutionId)
+		err := rows.Scan(
+			&item.Id, &item.AccessToken, &item.PlaidItemId, &item.PlaidInstitutionId, &item.Status,
+			&item.LastSyncedAt, &item.LastErrorCode, &item.LastErrorMessage, &item.ConsecutiveFailures)
 		if err != nil {
 			return nil, err
 		}
+		if item.AccessToken, err = db.tokens.Decrypt(item.AccessToken); err != nil {
+			return nil, fmt.Errorf("item %s: %w", item.PlaidItemId, err)
+		}
 		items = append(items, item)
 	}
 
@@ -0,0 +1,231 @@
+package expenses
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/plaid/plaid-go/v12/plaid"
+)
+
+func testDB(t *testing.T) *DB {
+	t.Helper()
+
+	db, err := NewDB(filepath.Join(t.TempDir(), "test.db"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+
+	return db
+}
+
+func testTransaction(id, accountId, date, merchant string, amount float64) plaid.Transaction {
+	txn := plaid.Transaction{
+		TransactionId:  id,
+		AccountId:      accountId,
+		Amount:         amount,
+		Date:           date,
+		Name:           merchant,
+		PaymentChannel: "in store",
+	}
+	txn.SetMerchantName(merchant)
+	txn.SetPersonalFinanceCategory(plaid.PersonalFinanceCategory{Primary: "FOOD_AND_DRINK", Detailed: "FOOD_AND_DRINK_GROCERIES"})
+
+	return txn
+}
+
+func TestUpdatePlaidTransactionsNormalizes(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+
+	added := []plaid.Transaction{
+		testTransaction("t1", "a1", "2023-06-01", "Costco", 120.5),
+		testTransaction("t2", "a1", "2023-06-02", "Safeway", 30),
+	}
+	removed := []plaid.RemovedTransaction{{TransactionId: plaid.PtrString("t2")}}
+	if _, err := db.UpdatePlaidTransactions(ctx, added, nil, removed, "item1", "cursor1"); err != nil {
+		t.Fatal(err)
+	}
+
+	var merchant, category, itemId string
+	var amount float64
+	err := db.db.QueryRow(
+		`SELECT merchant_name, category_detailed, plaid_item_id, amount
+		 FROM transactions WHERE plaid_transaction_id='t1'`).Scan(&merchant, &category, &itemId, &amount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if merchant != "Costco" || category != "FOOD_AND_DRINK_GROCERIES" || itemId != "item1" || amount != 120.5 {
+		t.Errorf("unexpected row %q %q %q %v", merchant, category, itemId, amount)
+	}
+
+	var deleted int
+	db.db.QueryRow(`SELECT COUNT(*) FROM transactions WHERE deleted_at IS NOT NULL`).Scan(&deleted)
+	if deleted != 1 {
+		t.Errorf("%d deleted transactions, want 1", deleted)
+	}
+
+	n, err := db.RebuildTransactions(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("rebuilt %d transactions, want 2", n)
+	}
+}
+
+func TestUpdatePlaidTransactionsModified(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+
+	pending := testTransaction("t1", "a1", "2023-06-01", "Costco", 100)
+	pending.Pending = true
+	if _, err := db.UpdatePlaidTransactions(ctx, []plaid.Transaction{pending}, nil, nil, "item1", "c1"); err != nil {
+		t.Fatal(err)
+	}
+
+	posted := testTransaction("t1", "a1", "2023-06-02", "Costco", 104.25)
+	if _, err := db.UpdatePlaidTransactions(ctx, nil, []plaid.Transaction{posted}, nil, "item1", "c2"); err != nil {
+		t.Fatal(err)
+	}
+
+	var amount float64
+	var isPending bool
+	db.db.QueryRow(`SELECT amount, pending FROM transactions WHERE plaid_transaction_id='t1'`).Scan(&amount, &isPending)
+	if amount != 104.25 || isPending {
+		t.Errorf("got amount %v pending %v, want the posted transaction", amount, isPending)
+	}
+
+	var revisions int
+	db.db.QueryRow(`SELECT COUNT(*) FROM plaid_transaction_revisions WHERE plaid_transaction_id='t1'`).Scan(&revisions)
+	if revisions != 1 {
+		t.Errorf("%d revisions, want 1", revisions)
+	}
+
+	// Every version of a transaction modified twice in one sync is kept
+	var versions []plaid.Transaction
+	for _, amount := range []float64{105, 106} {
+		versions = append(versions, testTransaction("t1", "a1", "2023-06-02", "Costco", amount))
+	}
+	if _, err := db.UpdatePlaidTransactions(ctx, nil, versions, nil, "item1", "c3"); err != nil {
+		t.Fatal(err)
+	}
+	db.db.QueryRow(`SELECT amount FROM transactions WHERE plaid_transaction_id='t1'`).Scan(&amount)
+	db.db.QueryRow(
+		`SELECT COUNT(DISTINCT json_extract(plaid_transaction, '$.amount'))
+		 FROM plaid_transaction_revisions WHERE plaid_transaction_id='t1'`).Scan(&revisions)
+	if amount != 106 || revisions != 3 {
+		t.Errorf("got amount %v with %d distinct revisions, want 106 with 3", amount, revisions)
+	}
+}
+
+func TestItemHealth(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+
+	if err := db.CreateNewItem(ctx, "item1", "access-token", "ins_1"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := db.RecordItemSyncFailure(ctx, "item1", "ITEM_LOGIN_REQUIRED", "login required"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	item, err := db.RetrieveItemByPlaidItemId(ctx, "item1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Status != ItemStatusLoginRequired || item.ConsecutiveFailures != 2 || item.LastErrorCode != "ITEM_LOGIN_REQUIRED" {
+		t.Errorf("unexpected item after failures %+v", item)
+	}
+
+	if err := db.RecordItemSyncSuccess(ctx, "item1"); err != nil {
+		t.Fatal(err)
+	}
+	item, err = db.RetrieveItemByPlaidItemId(ctx, "item1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.NeedsAttention() || item.ConsecutiveFailures != 0 || item.LastErrorCode != "" || item.LastSyncedAt == nil {
+		t.Errorf("unexpected item after success %+v", item)
+	}
+
+	// A pending expiration from the webhook survives a successful sync
+	if err := db.UpdateItemStatus(ctx, "item1", ItemStatusPendingExpiration); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.RecordItemSyncSuccess(ctx, "item1"); err != nil {
+		t.Fatal(err)
+	}
+	item, err = db.RetrieveItemByPlaidItemId(ctx, "item1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Status != ItemStatusPendingExpiration {
+		t.Errorf("got status %q after success, want %q", item.Status, ItemStatusPendingExpiration)
+	}
+}
+
+func TestRemoveItem(t *testing.T) {
+	ctx := context.Background()
+
+	for _, retain := range []bool{false, true} {
+		db := testDB(t)
+
+		if err := db.CreateNewItem(ctx, "item1", "access-token", "ins_1"); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.CreateAccounts(ctx, []Account{{PlaidAccountId: "a1"}}, "item1", "ins_1"); err != nil {
+			t.Fatal(err)
+		}
+		added := []plaid.Transaction{testTransaction("t1", "a1", "2023-06-01", "Costco", 10)}
+		if _, err := db.UpdatePlaidTransactions(ctx, added, nil, nil, "item1", "c1"); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := db.RemoveItem(ctx, "item1", retain); err != nil {
+			t.Fatal(err)
+		}
+
+		if item, _ := db.RetrieveItemByPlaidItemId(ctx, "item1"); item != nil {
+			t.Errorf("retain=%t: item still active", retain)
+		}
+		var cursors, txns, accounts int
+		db.db.QueryRow(`SELECT COUNT(*) FROM cursors`).Scan(&cursors)
+		db.db.QueryRow(`SELECT COUNT(*) FROM transactions`).Scan(&txns)
+		db.db.QueryRow(`SELECT COUNT(*) FROM accounts`).Scan(&accounts)
+		if cursors != 0 {
+			t.Errorf("retain=%t: cursor not removed", retain)
+		}
+		if want := map[bool]int{false: 0, true: 1}[retain]; txns != want || accounts != want {
+			t.Errorf("retain=%t: got %d transactions and %d accounts, want %d", retain, txns, accounts, want)
+		}
+	}
+}
+
+func TestCreateAccountsKeepsBalances(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+
+	balance := 1234.5
+	accounts := []Account{{PlaidAccountId: "a1", Name: "Checking", Type: "depository", CurrentBalance: &balance}}
+	if err := db.CreateAccounts(ctx, accounts, "item1", "ins_1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Relinking through Link has no balance
+	accounts = []Account{{PlaidAccountId: "a1", Name: "Checking", Type: "depository"}}
+	if err := db.CreateAccounts(ctx, accounts, "item1", "ins_1"); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := db.RetrieveAccounts(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].PlaidItemId != "item1" || got[0].CurrentBalance == nil || *got[0].CurrentBalance != balance {
+		t.Errorf("unexpected accounts %+v", got)
+	}
+}
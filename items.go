@@ -0,0 +1,33 @@
+package expenses
+
+import (
+	"context"
+	"errors"
+
+	"github.com/plaid/plaid-go/v12/plaid"
+)
+
+var errUnknownItem = errors.New("unknown item")
+
+// RemoveItem unlinks an item from Plaid, invalidating its access token, then
+// removes it from the DB. See DB.RemoveItem for the meaning of retainHistory.
+func RemoveItem(ctx context.Context, client *plaid.APIClient, db *DB, itemId string, retainHistory bool) error {
+	item, err := db.RetrieveItemByPlaidItemId(ctx, itemId)
+	if err != nil {
+		return err
+	}
+	if item == nil {
+		return errUnknownItem
+	}
+
+	irreq := plaid.NewItemRemoveRequest(item.AccessToken)
+	_, _, err = client.PlaidApi.ItemRemove(ctx).ItemRemoveRequest(*irreq).Execute()
+	if err != nil {
+		// Plaid no longer knowing about the item is what we wanted anyway
+		if code, _ := describeError(err); code != "ITEM_NOT_FOUND" {
+			return err
+		}
+	}
+
+	return db.RemoveItem(ctx, item.PlaidItemId, retainHistory)
+}
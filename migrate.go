@@ -0,0 +1,220 @@
+package expenses
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schema migrations live in migrations/ as numbered pairs of files, e.g.
+// 0002_add_foo.up.sql and 0002_add_foo.down.sql. Applied versions are
+// recorded in the schema_migrations table.
+//
+//go:embed migrations/*.sql
+var migrationsFS embed.FS
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+type MigrationStatus struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+func loadMigrations() ([]Migration, error) {
+	files, err := fs.Glob(migrationsFS, "migrations/*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, file := range files {
+		base := path.Base(file)
+		name, direction, ok := strings.Cut(strings.TrimSuffix(base, ".sql"), ".")
+		if !ok || (direction != "up" && direction != "down") {
+			return nil, fmt.Errorf("migration %s: expected <version>_<name>.up|down.sql", base)
+		}
+		verStr, name, _ := strings.Cut(name, "_")
+		version, err := strconv.Atoi(verStr)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s: bad version: %w", base, err)
+		}
+
+		query, err := migrationsFS.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		m := byVersion[version]
+		if m == nil {
+			m = &Migration{Version: version, Name: name}
+			byVersion[version] = m
+		}
+		if direction == "up" {
+			m.Up = string(query)
+		} else {
+			m.Down = string(query)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %d has no up migration", m.Version)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+
+	return migrations, nil
+}
+
+func (db *DB) ensureMigrationsTable(ctx context.Context) error {
+	_, err := db.db.ExecContext(
+		ctx,
+		`CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER NOT NULL PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`)
+
+	return err
+}
+
+func (db *DB) appliedMigrations(ctx context.Context) (map[int]time.Time, error) {
+	if err := db.ensureMigrationsTable(ctx); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.db.QueryContext(ctx, `SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+
+	return applied, rows.Err()
+}
+
+// MigrationStatus lists every known migration and when it was applied, if it
+// has been.
+func (db *DB) MigrationStatus(ctx context.Context) ([]MigrationStatus, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	applied, err := db.appliedMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	status := make([]MigrationStatus, len(migrations))
+	for i, m := range migrations {
+		status[i].Migration = m
+		if at, ok := applied[m.Version]; ok {
+			status[i].AppliedAt = &at
+		}
+	}
+
+	return status, nil
+}
+
+// MigrateUp applies pending migrations up to and including version target. A
+// target of 0 applies all pending migrations.
+func (db *DB) MigrateUp(ctx context.Context, target int) ([]Migration, error) {
+	status, err := db.MigrationStatus(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var done []Migration
+	for _, s := range status {
+		if target != 0 && s.Version > target {
+			break
+		}
+		if s.AppliedAt != nil {
+			continue
+		}
+
+		err := db.applyMigration(ctx, s.Version, s.Up, func(txn execer) error {
+			_, err := txn.ExecContext(
+				ctx,
+				`INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`, s.Version, s.Name)
+			return err
+		})
+		if err != nil {
+			return done, err
+		}
+		done = append(done, s.Migration)
+	}
+
+	return done, nil
+}
+
+// MigrateDown reverts the most recently applied steps migrations.
+func (db *DB) MigrateDown(ctx context.Context, steps int) ([]Migration, error) {
+	status, err := db.MigrationStatus(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var done []Migration
+	for i := len(status) - 1; i >= 0 && len(done) < steps; i-- {
+		s := status[i]
+		if s.AppliedAt == nil {
+			continue
+		}
+		if s.Down == "" {
+			return done, fmt.Errorf("migration %d_%s cannot be reverted, it has no down migration", s.Version, s.Name)
+		}
+
+		err := db.applyMigration(ctx, s.Version, s.Down, func(txn execer) error {
+			_, err := txn.ExecContext(ctx, `DELETE FROM schema_migrations WHERE version=$1`, s.Version)
+			return err
+		})
+		if err != nil {
+			return done, err
+		}
+		done = append(done, s.Migration)
+	}
+
+	return done, nil
+}
+
+// applyMigration runs the migration SQL and the bookkeeping in a single
+// transaction so a failed migration leaves the schema untouched.
+func (db *DB) applyMigration(ctx context.Context, version int, query string, record func(execer) error) error {
+	txn, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer txn.Rollback()
+
+	if _, err = txn.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("migration %d: %w", version, err)
+	}
+	if err = record(txn); err != nil {
+		return err
+	}
+
+	return txn.Commit()
+}
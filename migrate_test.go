@@ -0,0 +1,34 @@
+package expenses
+
+import (
+	"context"
+	"testing"
+)
+
+func TestMigrations(t *testing.T) {
+	ctx := context.Background()
+
+	db := testDB(t)
+
+	status, err := db.MigrationStatus(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range status {
+		if s.AppliedAt == nil {
+			t.Errorf("migration %d not applied by NewDB", s.Version)
+		}
+	}
+
+	// Every migration must be reversible and re-applicable
+	done, err := db.MigrateDown(ctx, len(status))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(done) != len(status) {
+		t.Errorf("reverted %d migrations, want %d", len(done), len(status))
+	}
+	if _, err := db.MigrateUp(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS plaid_transactions;
+DROP TABLE IF EXISTS items;
+DROP TABLE IF EXISTS institutions;
+DROP TABLE IF EXISTS cursors;
+DROP TABLE IF EXISTS accounts;
@@ -34,4 +34,4 @@ CREATE TABLE IF NOT EXISTS plaid_transactions (
     plaid_transaction TEXT NOT NULL,
     plaid_transaction_id TEXT UNIQUE NOT NULL,
     deleted_at TIMESTAMPTZ DEFAULT NULL
-)
\ No newline at end of file
+);
@@ -0,0 +1,2 @@
+DROP TABLE transactions;
+ALTER TABLE plaid_transactions DROP COLUMN plaid_item_id;
@@ -0,0 +1,58 @@
+-- Remember which item each raw transaction was synced from. Existing rows are
+-- matched to an item through the account's institution.
+ALTER TABLE plaid_transactions ADD COLUMN plaid_item_id TEXT;
+
+UPDATE plaid_transactions
+SET plaid_item_id = (
+    SELECT i.plaid_item_id
+    FROM accounts a
+    JOIN items i ON i.plaid_institution_id = a.plaid_institution_id
+    WHERE a.plaid_account_id = json_extract(plaid_transactions.plaid_transaction, '$.account_id')
+    LIMIT 1
+);
+
+-- Normalized copy of the Plaid transaction JSON in plaid_transactions
+CREATE TABLE transactions (
+    id INTEGER PRIMARY KEY,
+    plaid_transaction_id TEXT UNIQUE NOT NULL,
+    plaid_item_id TEXT,
+    plaid_account_id TEXT NOT NULL,
+    date TEXT NOT NULL,
+    authorized_date TEXT,
+    amount REAL NOT NULL,
+    iso_currency_code TEXT,
+    merchant_name TEXT,
+    name TEXT NOT NULL,
+    pending INTEGER NOT NULL DEFAULT 0,
+    category TEXT,
+    category_detailed TEXT,
+    payment_channel TEXT,
+    deleted_at TIMESTAMPTZ DEFAULT NULL
+);
+
+CREATE INDEX transactions_date ON transactions (date);
+CREATE INDEX transactions_account_date ON transactions (plaid_account_id, date);
+CREATE INDEX transactions_item ON transactions (plaid_item_id);
+CREATE INDEX transactions_category ON transactions (category, category_detailed);
+CREATE INDEX transactions_merchant ON transactions (merchant_name);
+
+INSERT INTO transactions
+    (plaid_transaction_id, plaid_item_id, plaid_account_id, date, authorized_date, amount,
+     iso_currency_code, merchant_name, name, pending, category, category_detailed,
+     payment_channel, deleted_at)
+SELECT plaid_transaction_id,
+       plaid_item_id,
+       json_extract(plaid_transaction, '$.account_id'),
+       json_extract(plaid_transaction, '$.date'),
+       json_extract(plaid_transaction, '$.authorized_date'),
+       json_extract(plaid_transaction, '$.amount'),
+       COALESCE(json_extract(plaid_transaction, '$.iso_currency_code'),
+                json_extract(plaid_transaction, '$.unofficial_currency_code')),
+       json_extract(plaid_transaction, '$.merchant_name'),
+       json_extract(plaid_transaction, '$.name'),
+       json_extract(plaid_transaction, '$.pending'),
+       json_extract(plaid_transaction, '$.personal_finance_category.primary'),
+       json_extract(plaid_transaction, '$.personal_finance_category.detailed'),
+       json_extract(plaid_transaction, '$.payment_channel'),
+       deleted_at
+FROM plaid_transactions;
@@ -0,0 +1 @@
+DROP TABLE plaid_transaction_revisions;
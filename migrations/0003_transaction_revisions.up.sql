@@ -0,0 +1,10 @@
+-- Previous versions of transactions that Plaid reported as modified
+CREATE TABLE plaid_transaction_revisions (
+    id INTEGER PRIMARY KEY,
+    plaid_transaction_id TEXT NOT NULL,
+    plaid_transaction TEXT NOT NULL,
+    deleted_at TIMESTAMPTZ DEFAULT NULL,
+    revised_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX plaid_transaction_revisions_transaction ON plaid_transaction_revisions (plaid_transaction_id);
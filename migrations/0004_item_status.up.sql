@@ -0,0 +1 @@
+ALTER TABLE items ADD COLUMN status TEXT NOT NULL DEFAULT 'ok';
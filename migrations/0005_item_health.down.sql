@@ -0,0 +1,4 @@
+ALTER TABLE items DROP COLUMN consecutive_failures;
+ALTER TABLE items DROP COLUMN last_error_message;
+ALTER TABLE items DROP COLUMN last_error_code;
+ALTER TABLE items DROP COLUMN last_synced_at;
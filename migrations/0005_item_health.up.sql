@@ -0,0 +1,4 @@
+ALTER TABLE items ADD COLUMN last_synced_at TIMESTAMP;
+ALTER TABLE items ADD COLUMN last_error_code TEXT;
+ALTER TABLE items ADD COLUMN last_error_message TEXT;
+ALTER TABLE items ADD COLUMN consecutive_failures INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,2 @@
+ALTER TABLE accounts DROP COLUMN archived_at;
+ALTER TABLE items DROP COLUMN removed_at;
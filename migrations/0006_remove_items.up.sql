@@ -0,0 +1,3 @@
+-- Items removed from Plaid whose history was retained
+ALTER TABLE items ADD COLUMN removed_at TIMESTAMP;
+ALTER TABLE accounts ADD COLUMN archived_at TIMESTAMP;
@@ -0,0 +1,8 @@
+DROP INDEX accounts_item;
+ALTER TABLE accounts DROP COLUMN balance_updated_at;
+ALTER TABLE accounts DROP COLUMN available_balance;
+ALTER TABLE accounts DROP COLUMN current_balance;
+ALTER TABLE accounts DROP COLUMN iso_currency_code;
+ALTER TABLE accounts DROP COLUMN official_name;
+ALTER TABLE accounts DROP COLUMN name;
+ALTER TABLE accounts DROP COLUMN plaid_item_id;
@@ -0,0 +1,24 @@
+ALTER TABLE accounts ADD COLUMN plaid_item_id TEXT;
+ALTER TABLE accounts ADD COLUMN name TEXT;
+ALTER TABLE accounts ADD COLUMN official_name TEXT;
+ALTER TABLE accounts ADD COLUMN iso_currency_code TEXT;
+ALTER TABLE accounts ADD COLUMN current_balance REAL;
+ALTER TABLE accounts ADD COLUMN available_balance REAL;
+ALTER TABLE accounts ADD COLUMN balance_updated_at TIMESTAMP;
+
+-- Link existing accounts to their item, through their transactions or failing
+-- that the only item at their institution
+UPDATE accounts
+SET plaid_item_id = COALESCE(
+    (SELECT t.plaid_item_id
+     FROM transactions t
+     WHERE t.plaid_account_id = accounts.plaid_account_id AND t.plaid_item_id IS NOT NULL
+     LIMIT 1),
+    (SELECT i.plaid_item_id
+     FROM items i
+     WHERE i.plaid_institution_id = accounts.plaid_institution_id
+     GROUP BY i.plaid_institution_id
+     HAVING COUNT(*) = 1)
+);
+
+CREATE INDEX accounts_item ON accounts (plaid_item_id);
@@ -0,0 +1,12 @@
+-- Account balances recorded every time they are refreshed from Plaid
+CREATE TABLE balance_snapshots (
+    id INTEGER PRIMARY KEY,
+    plaid_account_id TEXT NOT NULL,
+    date TEXT NOT NULL,
+    current_balance REAL,
+    available_balance REAL,
+    iso_currency_code TEXT,
+    taken_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX balance_snapshots_account_date ON balance_snapshots (plaid_account_id, date);
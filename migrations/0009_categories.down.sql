@@ -0,0 +1,3 @@
+DROP TABLE transaction_overrides;
+DROP TABLE category_mappings;
+DROP TABLE categories;
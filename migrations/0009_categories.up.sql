@@ -0,0 +1,65 @@
+-- Our own category taxonomy. Categories nest under parent_id.
+CREATE TABLE categories (
+    id INTEGER PRIMARY KEY,
+    name TEXT NOT NULL,
+    parent_id INTEGER REFERENCES categories(id),
+    color TEXT,
+    icon TEXT
+);
+
+CREATE UNIQUE INDEX categories_parent_name ON categories (COALESCE(parent_id, 0), name);
+
+-- Maps Plaid personal_finance_category values, primary or detailed, to our
+-- categories. A mapping of the detailed value wins over the primary.
+CREATE TABLE category_mappings (
+    plaid_category TEXT PRIMARY KEY,
+    category_id INTEGER NOT NULL REFERENCES categories(id)
+);
+
+-- Categories chosen by hand for individual transactions, these win over any
+-- mapping. Keyed by Plaid id so they survive transactions being rebuilt.
+CREATE TABLE transaction_overrides (
+    plaid_transaction_id TEXT PRIMARY KEY,
+    category_id INTEGER REFERENCES categories(id),
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Start with one category per Plaid primary category
+INSERT INTO categories (name, color) VALUES
+    ('Income', '#2e7d32'),
+    ('Transfers', '#607d8b'),
+    ('Loan Payments', '#795548'),
+    ('Bank Fees', '#9e9e9e'),
+    ('Entertainment', '#8e24aa'),
+    ('Food & Drink', '#ef6c00'),
+    ('Shopping', '#1e88e5'),
+    ('Home', '#6d4c41'),
+    ('Medical', '#e53935'),
+    ('Personal Care', '#d81b60'),
+    ('Services', '#3949ab'),
+    ('Government & Non-Profit', '#00897b'),
+    ('Transportation', '#fdd835'),
+    ('Travel', '#00acc1'),
+    ('Rent & Utilities', '#5e35b1');
+
+INSERT INTO category_mappings (plaid_category, category_id)
+SELECT m.plaid_category, c.id
+FROM (
+    SELECT 'INCOME' AS plaid_category, 'Income' AS name
+    UNION ALL SELECT 'TRANSFER_IN', 'Transfers'
+    UNION ALL SELECT 'TRANSFER_OUT', 'Transfers'
+    UNION ALL SELECT 'LOAN_PAYMENTS', 'Loan Payments'
+    UNION ALL SELECT 'BANK_FEES', 'Bank Fees'
+    UNION ALL SELECT 'ENTERTAINMENT', 'Entertainment'
+    UNION ALL SELECT 'FOOD_AND_DRINK', 'Food & Drink'
+    UNION ALL SELECT 'GENERAL_MERCHANDISE', 'Shopping'
+    UNION ALL SELECT 'HOME_IMPROVEMENT', 'Home'
+    UNION ALL SELECT 'MEDICAL', 'Medical'
+    UNION ALL SELECT 'PERSONAL_CARE', 'Personal Care'
+    UNION ALL SELECT 'GENERAL_SERVICES', 'Services'
+    UNION ALL SELECT 'GOVERNMENT_AND_NON_PROFIT', 'Government & Non-Profit'
+    UNION ALL SELECT 'TRANSPORTATION', 'Transportation'
+    UNION ALL SELECT 'TRAVEL', 'Travel'
+    UNION ALL SELECT 'RENT_AND_UTILITIES', 'Rent & Utilities'
+) m
+JOIN categories c ON c.name=m.name AND c.parent_id IS NULL;
@@ -0,0 +1,5 @@
+DROP TABLE rule_results;
+DROP TABLE transaction_tags;
+DROP TABLE rule_tags;
+DROP TABLE tags;
+DROP TABLE rules;
@@ -0,0 +1,54 @@
+-- User-defined rules that categorize and tag transactions as they arrive.
+-- Empty conditions match anything, every matching rule applies in priority
+-- order.
+CREATE TABLE rules (
+    id INTEGER PRIMARY KEY,
+    name TEXT NOT NULL,
+    priority INTEGER NOT NULL DEFAULT 0,
+    disabled BOOLEAN NOT NULL DEFAULT 0,
+    -- Conditions
+    merchant TEXT,
+    pattern TEXT,
+    min_amount REAL,
+    max_amount REAL,
+    plaid_account_id TEXT,
+    plaid_category TEXT,
+    -- Actions
+    set_category_id INTEGER REFERENCES categories(id),
+    rename_merchant TEXT,
+    mark_transfer BOOLEAN NOT NULL DEFAULT 0,
+    hide BOOLEAN NOT NULL DEFAULT 0,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE tags (
+    id INTEGER PRIMARY KEY,
+    name TEXT UNIQUE NOT NULL
+);
+
+-- Tags added by a rule
+CREATE TABLE rule_tags (
+    rule_id INTEGER NOT NULL REFERENCES rules(id),
+    tag_id INTEGER NOT NULL REFERENCES tags(id),
+    PRIMARY KEY (rule_id, tag_id)
+);
+
+-- Tags on transactions. Rows added by rules are replaced whenever rules are
+-- reapplied, others were added by hand and are left alone.
+CREATE TABLE transaction_tags (
+    plaid_transaction_id TEXT NOT NULL,
+    tag_id INTEGER NOT NULL REFERENCES tags(id),
+    added_by_rule BOOLEAN NOT NULL DEFAULT 0,
+    PRIMARY KEY (plaid_transaction_id, tag_id)
+);
+
+CREATE INDEX transaction_tags_tag ON transaction_tags (tag_id);
+
+-- The combined outcome of the rules matching a transaction, except tags
+CREATE TABLE rule_results (
+    plaid_transaction_id TEXT PRIMARY KEY,
+    category_id INTEGER REFERENCES categories(id),
+    merchant_name TEXT,
+    transfer BOOLEAN NOT NULL DEFAULT 0,
+    hidden BOOLEAN NOT NULL DEFAULT 0
+);
@@ -0,0 +1 @@
+DROP TABLE transaction_notes;
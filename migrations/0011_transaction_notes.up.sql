@@ -0,0 +1,7 @@
+-- Free text notes on transactions. Keyed by Plaid id so they survive
+-- transactions being modified or rebuilt.
+CREATE TABLE transaction_notes (
+    plaid_transaction_id TEXT PRIMARY KEY,
+    note TEXT NOT NULL,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
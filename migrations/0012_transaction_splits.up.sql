@@ -0,0 +1,12 @@
+-- Allocations of a transaction's amount across categories. The amounts of a
+-- transaction's splits sum to its amount when they are saved.
+CREATE TABLE transaction_splits (
+    id INTEGER PRIMARY KEY,
+    plaid_transaction_id TEXT NOT NULL,
+    position INTEGER NOT NULL,
+    amount REAL NOT NULL,
+    category_id INTEGER REFERENCES categories(id),
+    note TEXT
+);
+
+CREATE INDEX transaction_splits_transaction ON transaction_splits (plaid_transaction_id, position);
@@ -0,0 +1,11 @@
+-- Monthly spending limits per category, which include subcategories. With
+-- rollover, what is left unspent in a month adds to the next month's budget,
+-- counting from start_month (YYYY-MM).
+CREATE TABLE budgets (
+    id INTEGER PRIMARY KEY,
+    category_id INTEGER UNIQUE NOT NULL REFERENCES categories(id),
+    amount REAL NOT NULL,
+    rollover BOOLEAN NOT NULL DEFAULT 0,
+    start_month TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,2 @@
+DELETE FROM transaction_overrides WHERE category_id IS NULL;
+ALTER TABLE transaction_overrides DROP COLUMN kind;
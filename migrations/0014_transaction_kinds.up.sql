@@ -0,0 +1,3 @@
+-- Whether a transaction is income, an expense or a transfer between our own
+-- accounts, when set by hand. Overrides may now set a kind, a category or both.
+ALTER TABLE transaction_overrides ADD COLUMN kind TEXT CHECK (kind IN ('income', 'expense', 'transfer'));
@@ -0,0 +1 @@
+DROP TABLE transfer_pairs;
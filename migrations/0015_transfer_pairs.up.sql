@@ -0,0 +1,15 @@
+-- The two legs of a transfer between our own accounts: money out of one
+-- account and the same amount into another. Unambiguous pairs are matched
+-- automatically, others wait in review. Rejected pairs are kept so they
+-- aren't proposed again.
+CREATE TABLE transfer_pairs (
+    id INTEGER PRIMARY KEY,
+    out_transaction_id TEXT NOT NULL,
+    in_transaction_id TEXT NOT NULL,
+    status TEXT NOT NULL CHECK (status IN ('matched', 'review', 'rejected')),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE UNIQUE INDEX transfer_pairs_legs ON transfer_pairs (out_transaction_id, in_transaction_id);
+CREATE INDEX transfer_pairs_in ON transfer_pairs (in_transaction_id);
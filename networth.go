@@ -0,0 +1,261 @@
+package expenses
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+var errNetWorthDate = errors.New("bad date, want YYYY-MM-DD")
+
+type BalanceSnapshot struct {
+	PlaidAccountId string
+	Date           string // YYYY-MM-DD
+	CurrentBalance float64
+}
+
+// NetWorthPoint totals the balances in one currency on a date
+type NetWorthPoint struct {
+	Date        string  `json:"date"`
+	Currency    string  `json:"currency"`
+	Assets      float64 `json:"assets"`
+	Liabilities float64 `json:"liabilities"`
+	NetWorth    float64 `json:"net_worth"`
+}
+
+// isLiability reports whether balances of a Plaid account type are owed
+// rather than owned.
+func isLiability(accountType string) bool {
+	return accountType == "credit" || accountType == "loan"
+}
+
+// RecordBalanceSnapshots saves the current balance of each account that has
+// one.
+func (db *DB) RecordBalanceSnapshots(ctx context.Context, accounts []Account, takenAt time.Time) error {
+	txn, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer txn.Rollback()
+
+	for _, acct := range accounts {
+		if acct.CurrentBalance == nil {
+			continue
+		}
+
+		_, err := txn.ExecContext(
+			ctx,
+			`INSERT INTO balance_snapshots
+				(plaid_account_id, date, current_balance, available_balance, iso_currency_code, taken_at)
+			VALUES ($1, $2, $3, $4, $5, $6)`,
+			acct.PlaidAccountId, takenAt.Format(time.DateOnly), acct.CurrentBalance, acct.AvailableBalance, acct.IsoCurrencyCode, takenAt)
+		if err != nil {
+			return err
+		}
+	}
+
+	return txn.Commit()
+}
+
+// RetrieveDailyBalances returns the last balance snapshot of each account for
+// each day up to and including end, ordered by date.
+func (db *DB) RetrieveDailyBalances(ctx context.Context, end string) ([]BalanceSnapshot, error) {
+	rows, err := db.db.QueryContext(
+		ctx,
+		`SELECT plaid_account_id, date, current_balance
+		 FROM balance_snapshots
+		 WHERE id IN (SELECT MAX(id) FROM balance_snapshots GROUP BY plaid_account_id, date)
+			AND current_balance IS NOT NULL
+			AND date<=$1
+		 ORDER BY date, plaid_account_id`, end)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var snaps []BalanceSnapshot
+	for rows.Next() {
+		var snap BalanceSnapshot
+		if err := rows.Scan(&snap.PlaidAccountId, &snap.Date, &snap.CurrentBalance); err != nil {
+			return nil, err
+		}
+		snaps = append(snaps, snap)
+	}
+
+	return snaps, rows.Err()
+}
+
+// netWorthTimeline totals assets and liabilities for every date with a
+// snapshot on or after start, with a point for each currency ordered by
+// currency code. Accounts without a snapshot on a date carry their previous
+// balance forward. Snapshots must be ordered by date and snapshots of accounts
+// not in accounts are ignored.
+func netWorthTimeline(accounts map[string]*Account, snaps []BalanceSnapshot, start string) []NetWorthPoint {
+	balances := make(map[string]float64)
+	var timeline []NetWorthPoint
+
+	for i, snap := range snaps {
+		if _, ok := accounts[snap.PlaidAccountId]; ok {
+			balances[snap.PlaidAccountId] = snap.CurrentBalance
+		}
+
+		// Emit a point once all of a date's snapshots have been seen
+		if i+1 < len(snaps) && snaps[i+1].Date == snap.Date {
+			continue
+		}
+		if snap.Date < start {
+			continue
+		}
+
+		byCurrency := make(map[string]*NetWorthPoint)
+		var currencies []string
+		for id, balance := range balances {
+			currency := accounts[id].IsoCurrencyCode
+			point, ok := byCurrency[currency]
+			if !ok {
+				point = &NetWorthPoint{Date: snap.Date, Currency: currency}
+				byCurrency[currency] = point
+				currencies = append(currencies, currency)
+			}
+			if isLiability(accounts[id].Type) {
+				point.Liabilities += balance
+			} else {
+				point.Assets += balance
+			}
+		}
+		sort.Strings(currencies)
+		for _, currency := range currencies {
+			point := byCurrency[currency]
+			point.NetWorth = point.Assets - point.Liabilities
+			timeline = append(timeline, *point)
+		}
+	}
+
+	return timeline
+}
+
+type accountBalances struct {
+	AccountId string           `json:"account_id"`
+	Name      string           `json:"name"`
+	Mask      string           `json:"mask"`
+	Type      string           `json:"type"`
+	Currency  string           `json:"currency"`
+	Liability bool             `json:"liability"`
+	Balances  []accountBalance `json:"balances"`
+}
+
+type accountBalance struct {
+	Date    string  `json:"date"`
+	Balance float64 `json:"balance"`
+}
+
+type netWorthReport struct {
+	ErrorMsg string            `json:",omitempty"`
+	Start    string            `json:"start"`
+	End      string            `json:"end"`
+	Accounts []accountBalances `json:"accounts"`
+	Totals   []NetWorthPoint   `json:"totals"`
+}
+
+// netWorth builds the per-account and total balance history between start and
+// end, which default to the last year. Snapshots are dated in UTC.
+func (srv *Server) netWorth(ctx context.Context, start, end string) (*netWorthReport, error) {
+	now := time.Now().UTC()
+	if end == "" {
+		end = now.Format(time.DateOnly)
+	}
+	if start == "" {
+		start = now.AddDate(-1, 0, 0).Format(time.DateOnly)
+	}
+	for _, date := range []string{start, end} {
+		if _, err := time.Parse(time.DateOnly, date); err != nil {
+			return nil, fmt.Errorf("%w: %q", errNetWorthDate, date)
+		}
+	}
+
+	accounts, err := srv.db.RetrieveAccounts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	snaps, err := srv.db.RetrieveDailyBalances(ctx, end)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &netWorthReport{Start: start, End: end}
+	byId := make(map[string]*Account, len(accounts))
+	perAccount := make(map[string]*accountBalances, len(accounts))
+	for _, acct := range accounts {
+		byId[acct.PlaidAccountId] = acct
+		perAccount[acct.PlaidAccountId] = &accountBalances{
+			AccountId: acct.PlaidAccountId,
+			Name:      acct.Name,
+			Mask:      acct.AccountMask,
+			Type:      acct.Type,
+			Currency:  acct.IsoCurrencyCode,
+			Liability: isLiability(acct.Type),
+		}
+	}
+
+	for _, snap := range snaps {
+		if ab, ok := perAccount[snap.PlaidAccountId]; ok && snap.Date >= start {
+			ab.Balances = append(ab.Balances, accountBalance{snap.Date, snap.CurrentBalance})
+		}
+	}
+	for _, ab := range perAccount {
+		report.Accounts = append(report.Accounts, *ab)
+	}
+	sort.Slice(report.Accounts, func(i, j int) bool { return report.Accounts[i].Name < report.Accounts[j].Name })
+	report.Totals = netWorthTimeline(byId, snaps, start)
+
+	return report, nil
+}
+
+// netWorthAPI returns balance history as JSON. Optional start and end query
+// parameters (YYYY-MM-DD) select the period.
+func (srv *Server) netWorthAPI() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+
+		q := req.URL.Query()
+		report, err := srv.netWorth(req.Context(), q.Get("start"), q.Get("end"))
+		if errors.Is(err, errNetWorthDate) {
+			returnJSON(w, http.StatusBadRequest, netWorthReport{ErrorMsg: err.Error()})
+			return
+		}
+		if err != nil {
+			returnJSON(w, http.StatusInternalServerError, netWorthReport{ErrorMsg: err.Error()})
+			return
+		}
+
+		returnJSON(w, http.StatusOK, report)
+	}
+}
+
+func (srv *Server) netWorthPage() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+
+		q := req.URL.Query()
+		report, err := srv.netWorth(req.Context(), q.Get("start"), q.Get("end"))
+		if errors.Is(err, errNetWorthDate) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		netWorthTmpl.Execute(w, report)
+	}
+}
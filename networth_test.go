@@ -0,0 +1,50 @@
+package expenses
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestNetWorthTimeline(t *testing.T) {
+	accounts := map[string]*Account{
+		"checking": {Type: "depository", IsoCurrencyCode: "USD"},
+		"card":     {Type: "credit", IsoCurrencyCode: "USD"},
+		"euros":    {Type: "depository", IsoCurrencyCode: "EUR"},
+	}
+	snaps := []BalanceSnapshot{
+		{"card", "2023-05-31", 50},
+		{"checking", "2023-05-31", 900},
+		{"card", "2023-06-01", 200},
+		{"checking", "2023-06-01", 1000},
+		{"archived", "2023-06-01", 5000},
+		{"card", "2023-06-02", 300}, // checking carried forward
+		{"euros", "2023-06-02", 400},
+	}
+
+	got := netWorthTimeline(accounts, snaps, "2023-06-01")
+	want := []NetWorthPoint{
+		{Date: "2023-06-01", Currency: "USD", Assets: 1000, Liabilities: 200, NetWorth: 800},
+		// Balances in different currencies are totalled separately
+		{Date: "2023-06-02", Currency: "EUR", Assets: 400, NetWorth: 400},
+		{Date: "2023-06-02", Currency: "USD", Assets: 1000, Liabilities: 300, NetWorth: 700},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestNetWorthDates(t *testing.T) {
+	srv := &Server{db: testDB(t)}
+	ctx := context.Background()
+
+	for _, dates := range [][2]string{{"June", ""}, {"", "2023-06-31"}} {
+		if _, err := srv.netWorth(ctx, dates[0], dates[1]); !errors.Is(err, errNetWorthDate) {
+			t.Errorf("got %v for dates %q, want %v", err, dates, errNetWorthDate)
+		}
+	}
+	if _, err := srv.netWorth(ctx, "2023-01-01", "2023-06-30"); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,499 @@
+package expenses
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/plaid/plaid-go/v12/plaid"
+)
+
+// Cadences of recurring transactions
+const (
+	CadenceWeekly  = "weekly"
+	CadenceMonthly = "monthly"
+	CadenceAnnual  = "annual"
+)
+
+// Statuses of recurring transactions
+const (
+	RecurringActive = "active"
+	RecurringMissed = "missed" // the next charge is late
+	RecurringEnded  = "ended"  // no charge for over two periods
+)
+
+// How far back to look for recurring charges
+const recurringLookbackYears = 3
+
+// How long the recurring streams Plaid reported for an item are reused before
+// asking again. Failures are retried sooner.
+const (
+	plaidRecurringTTL   = 6 * time.Hour
+	plaidRecurringRetry = 15 * time.Minute
+)
+
+// cadence describes how often a recurring charge happens
+type cadence struct {
+	name               string
+	minDays, maxDays   int // between charges
+	minCharges         int // to call it recurring
+	grace              int // days a charge can be late before it is missed
+	perYear            int
+	years, months, day int // step to the next charge
+}
+
+var cadences = []cadence{
+	{name: CadenceWeekly, minDays: 5, maxDays: 9, minCharges: 3, grace: 3, perYear: 52, day: 7},
+	{name: CadenceMonthly, minDays: 26, maxDays: 35, minCharges: 3, grace: 7, perYear: 12, months: 1},
+	{name: CadenceAnnual, minDays: 350, maxDays: 380, minCharges: 2, grace: 14, perYear: 1, years: 1},
+}
+
+// next returns when the charge n steps after one on t is due. Monthly and
+// annual steps that land past the end of a shorter month are due on its last
+// day, so a charge on Jan 31 is next due on Feb 28 rather than Mar 3.
+func (c cadence) next(t time.Time, n int) time.Time {
+	if c.day != 0 {
+		return t.AddDate(0, 0, n*c.day)
+	}
+
+	y, m, d := t.Date()
+	first := time.Date(y+n*c.years, m+time.Month(n*c.months), 1, 0, 0, 0, 0, t.Location())
+	if last := first.AddDate(0, 1, -1).Day(); d > last {
+		d = last
+	}
+
+	return time.Date(first.Year(), first.Month(), d, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+}
+
+// RecurringStream is a charge that repeats on a cadence, such as a
+// subscription
+type RecurringStream struct {
+	Key            string  `json:"key"` // the normalized merchant
+	Merchant       string  `json:"merchant"`
+	Cadence        string  `json:"cadence"`
+	Source         string  `json:"source"` // detected by us or reported by plaid
+	Status         string  `json:"status"`
+	Charges        int     `json:"charges"`
+	FirstDate      string  `json:"first_date"`
+	LastDate       string  `json:"last_date"`
+	LastAmount     float64 `json:"last_amount"`
+	PreviousAmount float64 `json:"previous_amount"`
+	PriceIncrease  bool    `json:"price_increase"` // the last charge was more than the one before
+	NextDate       string  `json:"next_date"`      // expected
+	NextAmount     float64 `json:"next_amount"`    // expected
+	AnnualCost     float64 `json:"annual_cost"`    // at the last amount
+}
+
+// recurringCharge is one transaction of a possible recurring stream
+type recurringCharge struct {
+	merchant string
+	date     time.Time
+	cents    int64
+}
+
+// normalizeMerchant reduces a merchant name to lower case words, so that
+// "NETFLIX.COM 8665797172" and "Netflix.com" group together
+func normalizeMerchant(name string) string {
+	words := strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return !unicode.IsLetter(r)
+	})
+
+	return strings.Join(words, " ")
+}
+
+// detectCadence returns the cadence charges, ordered by date, repeat on. Most
+// gaps between charges must fit the cadence, allowing for the odd skipped or
+// extra charge, and all but the last charge must be for similar amounts.
+func detectCadence(charges []recurringCharge) (cadence, bool) {
+	if len(charges) < 2 {
+		return cadence{}, false
+	}
+
+	gaps := make([]int, len(charges)-1)
+	for i := range gaps {
+		gaps[i] = int(charges[i+1].date.Sub(charges[i].date).Hours() / 24)
+	}
+	sorted := append([]int(nil), gaps...)
+	sort.Ints(sorted)
+	median := sorted[len(sorted)/2]
+
+	for _, c := range cadences {
+		if median < c.minDays || median > c.maxDays || len(charges) < c.minCharges {
+			continue
+		}
+		fit := 0
+		for _, gap := range gaps {
+			if gap >= c.minDays && gap <= c.maxDays {
+				fit++
+			}
+		}
+		if fit*4 < len(gaps)*3 {
+			return cadence{}, false
+		}
+
+		// The last charge may be a price increase, the ones before shouldn't
+		// vary by more than a quarter
+		earlier := make([]int64, len(charges)-1)
+		for i := range earlier {
+			earlier[i] = charges[i].cents
+		}
+		sort.Slice(earlier, func(i, j int) bool { return earlier[i] < earlier[j] })
+		typical := earlier[len(earlier)/2]
+		similar := 0
+		for _, cents := range earlier {
+			if cents*4 >= typical*3 && cents*4 <= typical*5 {
+				similar++
+			}
+		}
+		if similar*4 < len(earlier)*3 {
+			return cadence{}, false
+		}
+
+		return c, true
+	}
+
+	return cadence{}, false
+}
+
+// newRecurringStream summarizes charges, ordered by date, that repeat on c as
+// of asOf
+func newRecurringStream(key string, c cadence, charges []recurringCharge, asOf time.Time) *RecurringStream {
+	first, last := charges[0], charges[len(charges)-1]
+	previous := last
+	if len(charges) > 1 {
+		previous = charges[len(charges)-2]
+	}
+
+	next := c.next(last.date, 1)
+	rs := &RecurringStream{
+		Key:            key,
+		Merchant:       last.merchant,
+		Cadence:        c.name,
+		Status:         RecurringActive,
+		Charges:        len(charges),
+		FirstDate:      first.date.Format(time.DateOnly),
+		LastDate:       last.date.Format(time.DateOnly),
+		LastAmount:     float64(last.cents) / 100,
+		PreviousAmount: float64(previous.cents) / 100,
+		PriceIncrease:  last.cents > previous.cents,
+		NextDate:       next.Format(time.DateOnly),
+		NextAmount:     float64(last.cents) / 100,
+		AnnualCost:     float64(last.cents*int64(c.perYear)) / 100,
+	}
+	switch {
+	case asOf.After(c.next(last.date, 2).AddDate(0, 0, c.grace)):
+		rs.Status = RecurringEnded
+	case asOf.After(next.AddDate(0, 0, c.grace)):
+		rs.Status = RecurringMissed
+	}
+
+	return rs
+}
+
+// recurringCharges loads the expenses since start, ordered by date. If ids is
+// not empty only those transactions are loaded.
+func (db *DB) recurringCharges(ctx context.Context, start time.Time, ids []string) ([]recurringCharge, error) {
+	qb := &queryBuilder{}
+	qb.where("t.deleted_at IS NULL AND NOT t.pending AND t.amount>0")
+	qb.where(transactionKindSQL + "='expense'")
+	qb.where("t.date>=" + qb.arg(start.Format(time.DateOnly)))
+	if len(ids) > 0 {
+		placeholders := make([]string, len(ids))
+		for i, id := range ids {
+			placeholders[i] = qb.arg(id)
+		}
+		qb.where("t.plaid_transaction_id IN (" + strings.Join(placeholders, ",") + ")")
+	}
+
+	rows, err := db.db.QueryContext(
+		ctx,
+		`SELECT COALESCE(NULLIF(r.merchant_name, ''), NULLIF(t.merchant_name, ''), t.name), t.date, t.amount
+		 FROM transactions t`+effectiveCategoryJoinsSQL+qb.whereClause()+`
+		 ORDER BY t.date, t.id`, qb.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var charges []recurringCharge
+	for rows.Next() {
+		var c recurringCharge
+		var date string
+		var amount float64
+		if err := rows.Scan(&c.merchant, &date, &amount); err != nil {
+			return nil, err
+		}
+		if c.date, err = time.Parse(time.DateOnly, date); err != nil {
+			return nil, err
+		}
+		c.cents = toCents(amount)
+		charges = append(charges, c)
+	}
+
+	return charges, rows.Err()
+}
+
+// DetectRecurring groups expenses by merchant and returns those that repeat
+// weekly, monthly or annually, as of asOf. Active ones come first.
+func (db *DB) DetectRecurring(ctx context.Context, asOf time.Time) ([]*RecurringStream, error) {
+	charges, err := db.recurringCharges(ctx, asOf.AddDate(-recurringLookbackYears, 0, 0), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	byMerchant := make(map[string][]recurringCharge)
+	for _, c := range charges {
+		key := normalizeMerchant(c.merchant)
+		if key == "" {
+			continue
+		}
+		if _, ok := byMerchant[key]; !ok {
+			keys = append(keys, key)
+		}
+		byMerchant[key] = append(byMerchant[key], c)
+	}
+
+	var streams []*RecurringStream
+	for _, key := range keys {
+		if c, ok := detectCadence(byMerchant[key]); ok {
+			rs := newRecurringStream(key, c, byMerchant[key], asOf)
+			rs.Source = "detected"
+			streams = append(streams, rs)
+		}
+	}
+	sortRecurring(streams)
+
+	return streams, nil
+}
+
+// sortRecurring orders active streams first, then missed, then ended, the
+// most expensive first within each
+func sortRecurring(streams []*RecurringStream) {
+	rank := map[string]int{RecurringActive: 0, RecurringMissed: 1, RecurringEnded: 2}
+	sort.SliceStable(streams, func(i, j int) bool {
+		if ri, rj := rank[streams[i].Status], rank[streams[j].Status]; ri != rj {
+			return ri < rj
+		}
+		return streams[i].AnnualCost > streams[j].AnnualCost
+	})
+}
+
+// plaidCadences maps the frequencies Plaid reports to our cadences
+var plaidCadences = map[plaid.RecurringTransactionFrequency]cadence{
+	plaid.RECURRINGTRANSACTIONFREQUENCY_WEEKLY:   cadences[0],
+	plaid.RECURRINGTRANSACTIONFREQUENCY_MONTHLY:  cadences[1],
+	plaid.RECURRINGTRANSACTIONFREQUENCY_ANNUALLY: cadences[2],
+}
+
+type plaidRecurringEntry struct {
+	streams   []plaid.TransactionStream
+	failed    bool
+	fetchedAt time.Time
+}
+
+// plaidRecurringCache holds the outflow streams Plaid reported for each item,
+// so that viewing the recurring page doesn't call Plaid every time
+type plaidRecurringCache struct {
+	mu      sync.Mutex
+	entries map[string]plaidRecurringEntry
+}
+
+// get returns the cached streams of an item, and whether they are fresh
+func (c *plaidRecurringCache) get(itemId string, now time.Time) ([]plaid.TransactionStream, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[itemId]
+	ttl := plaidRecurringTTL
+	if e.failed {
+		ttl = plaidRecurringRetry
+	}
+	if !ok || now.Sub(e.fetchedAt) >= ttl {
+		return nil, false
+	}
+
+	return e.streams, true
+}
+
+func (c *plaidRecurringCache) put(itemId string, e plaidRecurringEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.entries == nil {
+		c.entries = make(map[string]plaidRecurringEntry)
+	}
+	c.entries[itemId] = e
+}
+
+// itemRecurringOutflows returns the recurring outflows Plaid reports for the
+// accounts of an item, from the cache when it is fresh
+func (srv *Server) itemRecurringOutflows(ctx context.Context, item *Item, accountIds []string) []plaid.TransactionStream {
+	now := time.Now()
+	if streams, ok := srv.plaidRecurring.get(item.PlaidItemId, now); ok {
+		return streams
+	}
+
+	req := plaid.NewTransactionsRecurringGetRequest(item.AccessToken, accountIds)
+	resp, _, err := srv.client.PlaidApi.TransactionsRecurringGet(ctx).TransactionsRecurringGetRequest(*req).Execute()
+	if err != nil {
+		_, msg := describeError(err)
+		log.Printf("Failed to get recurring transactions of item %s: %s", item.PlaidItemId, msg)
+		srv.plaidRecurring.put(item.PlaidItemId, plaidRecurringEntry{failed: true, fetchedAt: now})
+		return nil
+	}
+	streams := resp.GetOutflowStreams()
+	srv.plaidRecurring.put(item.PlaidItemId, plaidRecurringEntry{streams: streams, fetchedAt: now})
+
+	return streams
+}
+
+// plaidRecurringStreams asks Plaid for the recurring outflows of every item and
+// summarizes them from our copies of their transactions. Items Plaid can't
+// answer for, e.g. without the Recurring Transactions product, are skipped.
+func (srv *Server) plaidRecurringStreams(ctx context.Context, asOf time.Time) ([]*RecurringStream, error) {
+	items, err := srv.db.RetrieveItems(ctx)
+	if err != nil {
+		return nil, err
+	}
+	accounts, err := srv.db.RetrieveAccounts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	byItem := make(map[string][]string)
+	for _, acct := range accounts {
+		byItem[acct.PlaidItemId] = append(byItem[acct.PlaidItemId], acct.PlaidAccountId)
+	}
+
+	var streams []*RecurringStream
+	for _, item := range items {
+		if len(byItem[item.PlaidItemId]) == 0 {
+			continue
+		}
+		for _, ts := range srv.itemRecurringOutflows(ctx, item, byItem[item.PlaidItemId]) {
+			c, ok := plaidCadences[ts.GetFrequency()]
+			if !ok || !ts.GetIsActive() {
+				continue
+			}
+
+			charges, err := srv.db.recurringCharges(ctx, time.Time{}, ts.GetTransactionIds())
+			if err != nil {
+				return nil, err
+			}
+			if len(charges) == 0 {
+				continue
+			}
+
+			merchant := ts.GetMerchantName()
+			if merchant == "" {
+				merchant = ts.GetDescription()
+			}
+			rs := newRecurringStream(normalizeMerchant(merchant), c, charges, asOf)
+			rs.Source = "plaid"
+			streams = append(streams, rs)
+		}
+	}
+
+	return streams, nil
+}
+
+// recurring returns the recurring streams as of now, with those reported by
+// Plaid taking the place of ones we detected for the same merchant
+func (srv *Server) recurring(ctx context.Context) ([]*RecurringStream, error) {
+	now := time.Now()
+	streams, err := srv.db.DetectRecurring(ctx, now)
+	if err != nil || !srv.plaidRecurringEnabled {
+		return streams, err
+	}
+
+	fromPlaid, err := srv.plaidRecurringStreams(ctx, now)
+	if err != nil {
+		return nil, err
+	}
+	reported := make(map[string]bool)
+	for _, rs := range fromPlaid {
+		reported[rs.Key] = true
+	}
+	for _, rs := range streams {
+		if !reported[rs.Key] {
+			fromPlaid = append(fromPlaid, rs)
+		}
+	}
+	sortRecurring(fromPlaid)
+
+	return fromPlaid, nil
+}
+
+// listRecurring returns the recurring streams, optionally only those with the
+// status query parameter
+func (srv *Server) listRecurring() http.HandlerFunc {
+	type response struct {
+		ErrorMsg string             `json:",omitempty"`
+		Streams  []*RecurringStream `json:"streams"`
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+
+		var resp response
+
+		streams, err := srv.recurring(req.Context())
+		if err != nil {
+			resp.ErrorMsg = err.Error()
+			returnJSON(w, http.StatusInternalServerError, resp)
+			return
+		}
+		resp.Streams = []*RecurringStream{}
+		status := req.URL.Query().Get("status")
+		for _, rs := range streams {
+			if status == "" || rs.Status == status {
+				resp.Streams = append(resp.Streams, rs)
+			}
+		}
+
+		returnJSON(w, http.StatusOK, resp)
+	}
+}
+
+// recurringPage lists active recurring charges, then those that stopped
+func (srv *Server) recurringPage() http.HandlerFunc {
+	type page struct {
+		Active, Ended []*RecurringStream
+		AnnualCost    float64 // of the active streams
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+
+		streams, err := srv.recurring(req.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		var p page
+		var cents int64
+		for _, rs := range streams {
+			if rs.Status == RecurringEnded {
+				p.Ended = append(p.Ended, rs)
+				continue
+			}
+			p.Active = append(p.Active, rs)
+			cents += toCents(rs.AnnualCost)
+		}
+		p.AnnualCost = float64(cents) / 100
+
+		recurringTmpl.Execute(w, p)
+	}
+}
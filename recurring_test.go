@@ -0,0 +1,139 @@
+package expenses
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/plaid/plaid-go/v12/plaid"
+)
+
+func TestNormalizeMerchant(t *testing.T) {
+	tests := map[string]string{
+		"NETFLIX.COM 8665797172": "netflix com",
+		"Netflix.com":            "netflix com",
+		"  Spotify   USA ":       "spotify usa",
+		"1234":                   "",
+	}
+	for name, want := range tests {
+		if got := normalizeMerchant(name); got != want {
+			t.Errorf("normalizeMerchant(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestCadenceNext(t *testing.T) {
+	monthly, annual := cadences[1], cadences[2]
+	tests := []struct {
+		c    cadence
+		from string
+		n    int
+		want string
+	}{
+		{monthly, "2023-01-15", 1, "2023-02-15"},
+		{monthly, "2023-01-31", 1, "2023-02-28"},
+		{monthly, "2023-01-31", 2, "2023-03-31"},
+		{monthly, "2023-12-31", 2, "2024-02-29"},
+		{annual, "2024-02-29", 1, "2025-02-28"},
+		{cadences[0], "2023-01-31", 1, "2023-02-07"},
+	}
+	for _, tt := range tests {
+		from, _ := time.Parse(time.DateOnly, tt.from)
+		if got := tt.c.next(from, tt.n).Format(time.DateOnly); got != tt.want {
+			t.Errorf("%s next(%s, %d) = %s, want %s", tt.c.name, tt.from, tt.n, got, tt.want)
+		}
+	}
+
+	// A monthly charge on the 31st is missed a week after the end of February
+	var charges []recurringCharge
+	for _, date := range []string{"2022-10-31", "2022-12-01", "2022-12-31", "2023-01-31"} {
+		d, _ := time.Parse(time.DateOnly, date)
+		charges = append(charges, recurringCharge{merchant: "Rent", date: d, cents: 100000})
+	}
+	rs := newRecurringStream("rent", monthly, charges, time.Date(2023, 3, 8, 0, 0, 0, 0, time.UTC))
+	if rs.NextDate != "2023-02-28" || rs.Status != RecurringMissed {
+		t.Errorf("got next charge %s and status %s, want 2023-02-28 and missed", rs.NextDate, rs.Status)
+	}
+}
+
+func TestPlaidRecurringCache(t *testing.T) {
+	var c plaidRecurringCache
+	now := time.Date(2023, 5, 20, 0, 0, 0, 0, time.UTC)
+	if _, ok := c.get("item1", now); ok {
+		t.Error("got streams from an empty cache")
+	}
+
+	c.put("item1", plaidRecurringEntry{streams: []plaid.TransactionStream{{StreamId: "s1"}}, fetchedAt: now})
+	c.put("item2", plaidRecurringEntry{failed: true, fetchedAt: now})
+	later := now.Add(plaidRecurringRetry)
+	if streams, ok := c.get("item1", later); !ok || len(streams) != 1 {
+		t.Errorf("got %v, %v for a fresh item, want the cached stream", streams, ok)
+	}
+	if _, ok := c.get("item2", later); ok {
+		t.Error("a failed lookup wasn't retried")
+	}
+	if _, ok := c.get("item1", now.Add(plaidRecurringTTL)); ok {
+		t.Error("got expired streams")
+	}
+}
+
+func TestDetectRecurring(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+
+	added := []plaid.Transaction{
+		// Monthly, with a price increase
+		testTransaction("n1", "a1", "2023-01-15", "NETFLIX.COM 8665797172", 9.99),
+		testTransaction("n2", "a1", "2023-02-15", "Netflix.com", 9.99),
+		testTransaction("n3", "a1", "2023-03-16", "NETFLIX.COM 8665797172", 9.99),
+		testTransaction("n4", "a1", "2023-04-15", "Netflix.com", 15.49),
+		// Weekly until the end of March
+		testTransaction("g1", "a1", "2023-03-06", "Gym", 10),
+		testTransaction("g2", "a1", "2023-03-13", "Gym", 10),
+		testTransaction("g3", "a1", "2023-03-20", "Gym", 10),
+		testTransaction("g4", "a1", "2023-03-27", "Gym", 10),
+		// Annual, and this year's charge is late
+		testTransaction("d1", "a1", "2021-05-01", "Domains", 12),
+		testTransaction("d2", "a1", "2022-05-01", "Domains", 12),
+		// Irregular
+		testTransaction("s1", "a1", "2023-01-03", "Safeway", 40),
+		testTransaction("s2", "a1", "2023-01-05", "Safeway", 12),
+		testTransaction("s3", "a1", "2023-01-20", "Safeway", 80),
+		testTransaction("s4", "a1", "2023-02-01", "Safeway", 33),
+		testTransaction("s5", "a1", "2023-03-02", "Safeway", 5),
+	}
+	if _, err := db.UpdatePlaidTransactions(ctx, added, nil, nil, "item1", "c1"); err != nil {
+		t.Fatal(err)
+	}
+
+	asOf := time.Date(2023, 5, 20, 0, 0, 0, 0, time.UTC)
+	streams, err := db.DetectRecurring(ctx, asOf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]*RecurringStream)
+	for _, rs := range streams {
+		got[rs.Key] = rs
+	}
+	if len(got) != 3 {
+		t.Errorf("got %d recurring streams, want 3", len(got))
+	}
+
+	netflix := got["netflix com"]
+	if netflix == nil || netflix.Cadence != CadenceMonthly || netflix.Charges != 4 || netflix.Status != RecurringActive {
+		t.Fatalf("got Netflix %+v, want 4 monthly charges", netflix)
+	}
+	if !netflix.PriceIncrease || netflix.PreviousAmount != 9.99 || netflix.NextAmount != 15.49 || netflix.NextDate != "2023-05-15" {
+		t.Errorf("got Netflix %+v, want a price increase to 15.49 and the next charge on 2023-05-15", netflix)
+	}
+	if streams[0] != netflix || netflix.AnnualCost != 185.88 {
+		t.Errorf("got Netflix costing %.2f a year, want 185.88 and first", netflix.AnnualCost)
+	}
+
+	if gym := got["gym"]; gym == nil || gym.Cadence != CadenceWeekly || gym.Status != RecurringEnded {
+		t.Errorf("got gym %+v, want weekly and ended", gym)
+	}
+	if domains := got["domains"]; domains == nil || domains.Cadence != CadenceAnnual || domains.Status != RecurringMissed {
+		t.Errorf("got domains %+v, want annual and missed", domains)
+	}
+}
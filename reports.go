@@ -0,0 +1,413 @@
+package expenses
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// reportFilterSQL leaves out of reports the allocations al that are deleted,
+// pending or hidden
+const reportFilterSQL = `NOT al.deleted AND NOT al.pending AND NOT al.hidden`
+
+// CategoryTotal is the amount spent in a category over a period. Spending is
+// positive, refunds and income negative, as with Plaid amounts.
+type CategoryTotal struct {
+	CategoryId   *int    `json:"category_id"` // nil for uncategorized
+	CategoryName string  `json:"category_name"`
+	Amount       float64 `json:"amount"`
+	Transactions int     `json:"transactions"`
+}
+
+// SpendingByCategory totals the allocations of transactions dated from start
+// to end inclusive, so split transactions count towards each split's
+// category. Deleted, pending and hidden transactions and transfers are left
+// out.
+func (db *DB) SpendingByCategory(ctx context.Context, start, end string) ([]*CategoryTotal, error) {
+	rows, err := db.db.QueryContext(
+		ctx,
+		`SELECT al.category_id, COALESCE(c.name, 'Uncategorized'), SUM(al.amount), COUNT(DISTINCT al.plaid_transaction_id)
+		 FROM (`+transactionAllocationsSQL+`) al
+		 LEFT JOIN categories c ON c.id=al.category_id
+		 WHERE al.date>=$1 AND al.date<=$2 AND `+reportFilterSQL+` AND al.kind<>'transfer'
+		 GROUP BY al.category_id
+		 ORDER BY SUM(al.amount) DESC`, start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var totals []*CategoryTotal
+	for rows.Next() {
+		ct := new(CategoryTotal)
+		if err := rows.Scan(&ct.CategoryId, &ct.CategoryName, &ct.Amount, &ct.Transactions); err != nil {
+			return nil, err
+		}
+		ct.Amount = float64(toCents(ct.Amount)) / 100
+		totals = append(totals, ct)
+	}
+
+	return totals, rows.Err()
+}
+
+// SpendingTotal is the amount spent with a merchant or from an account over a
+// period, signed as CategoryTotal.
+type SpendingTotal struct {
+	Key          string  `json:"key"`
+	Name         string  `json:"name"`
+	Amount       float64 `json:"amount"`
+	Transactions int     `json:"transactions"`
+}
+
+// spendingBy totals allocations like SpendingByCategory, grouped by keySQL.
+// joinSQL may join tables to allocations al for nameSQL.
+func (db *DB) spendingBy(ctx context.Context, keySQL, nameSQL, joinSQL, start, end string) ([]*SpendingTotal, error) {
+	rows, err := db.db.QueryContext(
+		ctx,
+		`SELECT `+keySQL+`, `+nameSQL+`, SUM(al.amount), COUNT(DISTINCT al.plaid_transaction_id)
+		 FROM (`+transactionAllocationsSQL+`) al`+joinSQL+`
+		 WHERE al.date>=$1 AND al.date<=$2 AND `+reportFilterSQL+` AND al.kind<>'transfer'
+		 GROUP BY 1
+		 ORDER BY SUM(al.amount) DESC`, start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var totals []*SpendingTotal
+	for rows.Next() {
+		st := new(SpendingTotal)
+		if err := rows.Scan(&st.Key, &st.Name, &st.Amount, &st.Transactions); err != nil {
+			return nil, err
+		}
+		st.Amount = float64(toCents(st.Amount)) / 100
+		totals = append(totals, st)
+	}
+
+	return totals, rows.Err()
+}
+
+// SpendingByMerchant totals spending per merchant, after rules have renamed
+// them, between start and end inclusive.
+func (db *DB) SpendingByMerchant(ctx context.Context, start, end string) ([]*SpendingTotal, error) {
+	return db.spendingBy(ctx, "al.merchant_name", "al.merchant_name", "", start, end)
+}
+
+// SpendingByAccount totals spending per account between start and end
+// inclusive.
+func (db *DB) SpendingByAccount(ctx context.Context, start, end string) ([]*SpendingTotal, error) {
+	return db.spendingBy(
+		ctx,
+		"al.plaid_account_id",
+		"COALESCE(NULLIF(a.name, ''), al.plaid_account_id) || COALESCE(' ...' || NULLIF(a.account_mask, ''), '')",
+		" LEFT JOIN accounts a ON a.plaid_account_id=al.plaid_account_id",
+		start, end)
+}
+
+// MonthSummary is the income and expenses of a month, leaving out transfers
+// between our own accounts. Refunds reduce expenses.
+type MonthSummary struct {
+	Month    string  `json:"month"` // YYYY-MM
+	Income   float64 `json:"income"`
+	Expenses float64 `json:"expenses"`
+	Net      float64 `json:"net"` // income less expenses
+
+	// Change in expenses from the month before as a fraction, nil if nothing
+	// was spent then
+	ExpensesChange *float64 `json:"expenses_change"`
+}
+
+// MonthlySummaries returns the income and expenses of each month from start
+// to end inclusive, including months without any.
+func (db *DB) MonthlySummaries(ctx context.Context, start, end string) ([]*MonthSummary, error) {
+	rows, err := db.db.QueryContext(
+		ctx,
+		`SELECT substr(al.date, 1, 7),
+			COALESCE(-SUM(CASE WHEN al.kind='income' THEN al.amount END), 0),
+			COALESCE(SUM(CASE WHEN al.kind='expense' THEN al.amount END), 0)
+		 FROM (`+transactionAllocationsSQL+`) al
+		 WHERE al.date>=$1 AND al.date<=$2 AND `+reportFilterSQL+`
+		 GROUP BY 1`, start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	byMonth := make(map[string]*MonthSummary)
+	for rows.Next() {
+		ms := new(MonthSummary)
+		if err := rows.Scan(&ms.Month, &ms.Income, &ms.Expenses); err != nil {
+			return nil, err
+		}
+		byMonth[ms.Month] = ms
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	first, err := time.Parse(time.DateOnly, start)
+	if err != nil {
+		return nil, err
+	}
+	last, err := time.Parse(time.DateOnly, end)
+	if err != nil {
+		return nil, err
+	}
+
+	var summaries []*MonthSummary
+	var prev *MonthSummary
+	for m := time.Date(first.Year(), first.Month(), 1, 0, 0, 0, 0, time.UTC); !m.After(last); m = m.AddDate(0, 1, 0) {
+		ms := byMonth[m.Format(monthLayout)]
+		if ms == nil {
+			ms = &MonthSummary{Month: m.Format(monthLayout)}
+		}
+		ms.Income = float64(toCents(ms.Income)) / 100
+		ms.Expenses = float64(toCents(ms.Expenses)) / 100
+		ms.Net = float64(toCents(ms.Income)-toCents(ms.Expenses)) / 100
+		if prev != nil && prev.Expenses != 0 {
+			change := (ms.Expenses - prev.Expenses) / prev.Expenses
+			ms.ExpensesChange = &change
+		}
+		summaries = append(summaries, ms)
+		prev = ms
+	}
+
+	return summaries, nil
+}
+
+// CategoryChange compares spending in a category between two months
+type CategoryChange struct {
+	CategoryId   *int    `json:"category_id"`
+	CategoryName string  `json:"category_name"`
+	Current      float64 `json:"current"`
+	Previous     float64 `json:"previous"`
+	Change       float64 `json:"change"`
+}
+
+// monthRange returns the first and last day of month m
+func monthRange(m time.Time) (string, string) {
+	first := time.Date(m.Year(), m.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return first.Format(time.DateOnly), first.AddDate(0, 1, -1).Format(time.DateOnly)
+}
+
+// MonthOverMonth compares spending per category in month (YYYY-MM) with the
+// month before, biggest increase first.
+func (db *DB) MonthOverMonth(ctx context.Context, month string) ([]*CategoryChange, error) {
+	m, err := parseMonth(month)
+	if err != nil {
+		return nil, err
+	}
+
+	start, end := monthRange(m)
+	current, err := db.SpendingByCategory(ctx, start, end)
+	if err != nil {
+		return nil, err
+	}
+	start, end = monthRange(m.AddDate(0, -1, 0))
+	previous, err := db.SpendingByCategory(ctx, start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	// Uncategorized spending has no id, key it by 0
+	byId := make(map[int]*CategoryChange)
+	var changes []*CategoryChange
+	change := func(ct *CategoryTotal) *CategoryChange {
+		key := 0
+		if ct.CategoryId != nil {
+			key = *ct.CategoryId
+		}
+		cc, ok := byId[key]
+		if !ok {
+			cc = &CategoryChange{CategoryId: ct.CategoryId, CategoryName: ct.CategoryName}
+			byId[key] = cc
+			changes = append(changes, cc)
+		}
+		return cc
+	}
+	for _, ct := range current {
+		change(ct).Current = ct.Amount
+	}
+	for _, ct := range previous {
+		change(ct).Previous = ct.Amount
+	}
+	for _, cc := range changes {
+		cc.Change = float64(toCents(cc.Current)-toCents(cc.Previous)) / 100
+	}
+	sort.SliceStable(changes, func(i, j int) bool { return changes[i].Change > changes[j].Change })
+
+	return changes, nil
+}
+
+// spendingReport is everything on the reports page for one period. Month over
+// month compares the month of the period's end with the month before.
+type spendingReport struct {
+	ErrorMsg       string            `json:",omitempty"`
+	Start          string            `json:"start"`
+	End            string            `json:"end"`
+	Income         float64           `json:"income"`
+	Expenses       float64           `json:"expenses"`
+	Net            float64           `json:"net"`
+	Months         []*MonthSummary   `json:"months"`
+	Categories     []*CategoryTotal  `json:"categories"`
+	Merchants      []*SpendingTotal  `json:"merchants"`
+	Accounts       []*SpendingTotal  `json:"accounts"`
+	CashFlow       []*CashFlow       `json:"cash_flow"`
+	Month          string            `json:"month"`
+	PreviousMonth  string            `json:"previous_month"`
+	MonthOverMonth []*CategoryChange `json:"month_over_month"`
+}
+
+func (srv *Server) spendingReport(ctx context.Context, start, end string) (*spendingReport, error) {
+	report := &spendingReport{Start: start, End: end}
+
+	var err error
+	if report.Months, err = srv.db.MonthlySummaries(ctx, start, end); err != nil {
+		return nil, err
+	}
+	var income, expenses int64
+	for _, ms := range report.Months {
+		income += toCents(ms.Income)
+		expenses += toCents(ms.Expenses)
+	}
+	report.Income = float64(income) / 100
+	report.Expenses = float64(expenses) / 100
+	report.Net = float64(income-expenses) / 100
+
+	if report.Categories, err = srv.db.SpendingByCategory(ctx, start, end); err != nil {
+		return nil, err
+	}
+	if report.Merchants, err = srv.db.SpendingByMerchant(ctx, start, end); err != nil {
+		return nil, err
+	}
+	if report.Accounts, err = srv.db.SpendingByAccount(ctx, start, end); err != nil {
+		return nil, err
+	}
+	if report.CashFlow, err = srv.db.CashFlowByAccount(ctx, start, end); err != nil {
+		return nil, err
+	}
+
+	last, err := time.Parse(time.DateOnly, end)
+	if err != nil {
+		return nil, err
+	}
+	report.Month = last.Format(monthLayout)
+	report.PreviousMonth = last.AddDate(0, 0, 1-last.Day()).AddDate(0, -1, 0).Format(monthLayout)
+	if report.MonthOverMonth, err = srv.db.MonthOverMonth(ctx, report.Month); err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+// reportPeriod reads the start and end query parameters, defaulting to the
+// current month
+func reportPeriod(req *http.Request) (start, end string, err error) {
+	now := time.Now()
+	start = req.URL.Query().Get("start")
+	if start == "" {
+		start = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.Local).Format(time.DateOnly)
+	}
+	end = req.URL.Query().Get("end")
+	if end == "" {
+		end = now.Format(time.DateOnly)
+	}
+
+	for _, date := range []string{start, end} {
+		if _, err := time.Parse(time.DateOnly, date); err != nil {
+			return "", "", fmt.Errorf("bad date %q, expected YYYY-MM-DD", date)
+		}
+	}
+
+	return start, end, nil
+}
+
+// spendingByCategory reports spending per category between the start and end
+// query parameters
+func (srv *Server) spendingByCategory() http.HandlerFunc {
+	type response struct {
+		ErrorMsg   string           `json:",omitempty"`
+		Start      string           `json:"start"`
+		End        string           `json:"end"`
+		Categories []*CategoryTotal `json:"categories"`
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+
+		var resp response
+
+		start, end, err := reportPeriod(req)
+		if err != nil {
+			resp.ErrorMsg = err.Error()
+			returnJSON(w, http.StatusBadRequest, resp)
+			return
+		}
+		resp.Start, resp.End = start, end
+
+		totals, err := srv.db.SpendingByCategory(req.Context(), start, end)
+		if err != nil {
+			resp.ErrorMsg = err.Error()
+			returnJSON(w, http.StatusInternalServerError, resp)
+			return
+		}
+		resp.Categories = totals
+		if resp.Categories == nil {
+			resp.Categories = []*CategoryTotal{}
+		}
+
+		returnJSON(w, http.StatusOK, resp)
+	}
+}
+
+// reports returns the full spending report between the start and end query
+// parameters
+func (srv *Server) reports() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+
+		start, end, err := reportPeriod(req)
+		if err != nil {
+			returnJSON(w, http.StatusBadRequest, spendingReport{ErrorMsg: err.Error()})
+			return
+		}
+		report, err := srv.spendingReport(req.Context(), start, end)
+		if err != nil {
+			returnJSON(w, http.StatusInternalServerError, spendingReport{ErrorMsg: err.Error()})
+			return
+		}
+
+		returnJSON(w, http.StatusOK, report)
+	}
+}
+
+func (srv *Server) reportsPage() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+
+		start, end, err := reportPeriod(req)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			reportsTmpl.Execute(w, spendingReport{ErrorMsg: err.Error()})
+			return
+		}
+		report, err := srv.spendingReport(req.Context(), start, end)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		reportsTmpl.Execute(w, report)
+	}
+}
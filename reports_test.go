@@ -0,0 +1,71 @@
+package expenses
+
+import (
+	"context"
+	"testing"
+
+	"github.com/plaid/plaid-go/v12/plaid"
+)
+
+func TestSpendingReports(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+
+	income := testTransaction("t4", "a2", "2023-06-20", "Employer", -1000)
+	income.SetPersonalFinanceCategory(plaid.PersonalFinanceCategory{Primary: "INCOME", Detailed: "INCOME_WAGES"})
+	added := []plaid.Transaction{
+		testTransaction("t1", "a1", "2023-05-03", "Safeway", 40),
+		testTransaction("t2", "a1", "2023-06-01", "Safeway", 50),
+		testTransaction("t3", "a2", "2023-06-15", "Costco", 30),
+		income,
+		testTransaction("t5", "a1", "2023-06-21", "Safeway", 500),
+	}
+	removed := []plaid.RemovedTransaction{{TransactionId: plaid.PtrString("t5")}}
+	if _, err := db.UpdatePlaidTransactions(ctx, added, nil, removed, "item1", "c1"); err != nil {
+		t.Fatal(err)
+	}
+
+	merchants, err := db.SpendingByMerchant(ctx, "2023-06-01", "2023-06-30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]float64)
+	for _, st := range merchants {
+		got[st.Name] = st.Amount
+	}
+	// The deleted t5 isn't counted
+	if len(got) != 3 || got["Safeway"] != 50 || got["Costco"] != 30 || got["Employer"] != -1000 {
+		t.Errorf("got merchant spending %v, want Safeway 50, Costco 30 and Employer -1000", got)
+	}
+
+	accounts, err := db.SpendingByAccount(ctx, "2023-06-01", "2023-06-30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(accounts) != 2 || accounts[0].Key != "a1" || accounts[0].Amount != 50 || accounts[1].Amount != -970 {
+		t.Errorf("got account spending %+v, want a1 50 then a2 -970", accounts)
+	}
+
+	months, err := db.MonthlySummaries(ctx, "2023-04-01", "2023-06-30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(months) != 3 || months[0].Month != "2023-04" || months[0].Expenses != 0 {
+		t.Fatalf("got months %+v, want April to June", months)
+	}
+	if m := months[2]; m.Income != 1000 || m.Expenses != 80 || m.Net != 920 || m.ExpensesChange == nil || *m.ExpensesChange != 1 {
+		t.Errorf("got June %+v, want 1000 in, 80 out and expenses doubled", m)
+	}
+	if months[1].ExpensesChange != nil {
+		t.Errorf("got a change in expenses for May, want none after a month without spending")
+	}
+
+	changes, err := db.MonthOverMonth(ctx, "2023-06")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 2 || changes[0].CategoryName != "Food & Drink" || changes[0].Previous != 40 || changes[0].Current != 80 ||
+		changes[0].Change != 40 || changes[1].CategoryName != "Income" || changes[1].Change != -1000 {
+		t.Errorf("got month over month %+v, want Food & Drink up 40 then Income", changes)
+	}
+}
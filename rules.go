@@ -0,0 +1,763 @@
+package expenses
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	errUnknownRule     = errors.New("unknown rule")
+	errRuleNoCondition = errors.New("rule needs at least one condition")
+	errRuleNoAction    = errors.New("rule needs at least one action")
+	errRuleBadPattern  = errors.New("bad pattern")
+)
+
+// Rule categorizes and tags transactions that match all of its conditions.
+// Empty conditions match anything. Every matching rule applies, in ascending
+// priority. The first rule to set a category or merchant name wins, tags
+// accumulate.
+type Rule struct {
+	Id       int    `json:"id"`
+	Name     string `json:"name"`
+	Priority int    `json:"priority"`
+	Disabled bool   `json:"disabled"`
+
+	// Conditions
+	Merchant      string   `json:"merchant,omitempty"` // case insensitive substring of the merchant name
+	Pattern       string   `json:"pattern,omitempty"`  // regexp matched against the raw description
+	MinAmount     *float64 `json:"min_amount,omitempty"`
+	MaxAmount     *float64 `json:"max_amount,omitempty"`
+	AccountId     string   `json:"account_id,omitempty"`
+	PlaidCategory string   `json:"plaid_category,omitempty"` // primary or detailed
+
+	// Actions
+	SetCategoryId  *int     `json:"set_category_id,omitempty"`
+	AddTags        []string `json:"add_tags,omitempty"`
+	RenameMerchant string   `json:"rename_merchant,omitempty"`
+	MarkTransfer   bool     `json:"mark_transfer,omitempty"`
+	Hide           bool     `json:"hide,omitempty"`
+
+	re *regexp.Regexp
+}
+
+// compile validates the rule and prepares it for matching
+func (r *Rule) compile() error {
+	if r.Merchant == "" && r.Pattern == "" && r.MinAmount == nil && r.MaxAmount == nil &&
+		r.AccountId == "" && r.PlaidCategory == "" {
+		return errRuleNoCondition
+	}
+	if r.SetCategoryId == nil && len(r.AddTags) == 0 && r.RenameMerchant == "" && !r.MarkTransfer && !r.Hide {
+		return errRuleNoAction
+	}
+
+	r.re = nil
+	if r.Pattern != "" {
+		re, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return fmt.Errorf("%w: %v", errRuleBadPattern, err)
+		}
+		r.re = re
+	}
+
+	return nil
+}
+
+// ruleSubject is the part of a transaction rules match against
+type ruleSubject struct {
+	PlaidTransactionId string
+	PlaidAccountId     string
+	Date               string
+	MerchantName       string
+	Name               string
+	Amount             float64
+	Category           string
+	CategoryDetailed   string
+}
+
+func (r *Rule) matches(s *ruleSubject) bool {
+	if r.Merchant != "" {
+		merchant := s.MerchantName
+		if merchant == "" {
+			merchant = s.Name
+		}
+		if !strings.Contains(strings.ToLower(merchant), strings.ToLower(r.Merchant)) {
+			return false
+		}
+	}
+	if r.re != nil && !r.re.MatchString(s.Name) {
+		return false
+	}
+	if r.MinAmount != nil && s.Amount < *r.MinAmount {
+		return false
+	}
+	if r.MaxAmount != nil && s.Amount > *r.MaxAmount {
+		return false
+	}
+	if r.AccountId != "" && r.AccountId != s.PlaidAccountId {
+		return false
+	}
+	if r.PlaidCategory != "" && r.PlaidCategory != s.Category && r.PlaidCategory != s.CategoryDetailed {
+		return false
+	}
+
+	return true
+}
+
+// RuleOutcome is the combined effect of the rules matching a transaction
+type RuleOutcome struct {
+	CategoryId   *int     `json:"category_id"`
+	MerchantName string   `json:"merchant_name,omitempty"`
+	Tags         []string `json:"tags,omitempty"`
+	Transfer     bool     `json:"transfer,omitempty"`
+	Hidden       bool     `json:"hidden,omitempty"`
+}
+
+// evaluateRules returns the outcome of applying rules, which must be sorted
+// by priority, to s. It returns nil if no rule matched.
+func evaluateRules(rules []*Rule, s *ruleSubject) *RuleOutcome {
+	var out *RuleOutcome
+	for _, r := range rules {
+		if r.Disabled || !r.matches(s) {
+			continue
+		}
+		if out == nil {
+			out = &RuleOutcome{}
+		}
+		if out.CategoryId == nil && r.SetCategoryId != nil {
+			id := *r.SetCategoryId
+			out.CategoryId = &id
+		}
+		if out.MerchantName == "" {
+			out.MerchantName = r.RenameMerchant
+		}
+		for _, tag := range r.AddTags {
+			if !containsString(out.Tags, tag) {
+				out.Tags = append(out.Tags, tag)
+			}
+		}
+		out.Transfer = out.Transfer || r.MarkTransfer
+		out.Hidden = out.Hidden || r.Hide
+	}
+	if out != nil {
+		sort.Strings(out.Tags)
+	}
+
+	return out
+}
+
+func containsString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (db *DB) RetrieveRules(ctx context.Context) ([]*Rule, error) {
+	return loadRules(ctx, db.db)
+}
+
+// loadRules returns every rule in priority order, ready for matching
+func loadRules(ctx context.Context, q queryer) ([]*Rule, error) {
+	rows, err := q.QueryContext(
+		ctx,
+		`SELECT id, name, priority, disabled,
+				COALESCE(merchant, ''), COALESCE(pattern, ''), min_amount, max_amount,
+				COALESCE(plaid_account_id, ''), COALESCE(plaid_category, ''),
+				set_category_id, COALESCE(rename_merchant, ''), mark_transfer, hide
+		 FROM rules
+		 ORDER BY priority, id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []*Rule
+	byId := make(map[int]*Rule)
+	for rows.Next() {
+		r := new(Rule)
+		err := rows.Scan(
+			&r.Id, &r.Name, &r.Priority, &r.Disabled,
+			&r.Merchant, &r.Pattern, &r.MinAmount, &r.MaxAmount,
+			&r.AccountId, &r.PlaidCategory,
+			&r.SetCategoryId, &r.RenameMerchant, &r.MarkTransfer, &r.Hide)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+		byId[r.Id] = r
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	rows, err = q.QueryContext(
+		ctx,
+		`SELECT rt.rule_id, tg.name
+		 FROM rule_tags rt
+		 JOIN tags tg ON tg.id=rt.tag_id
+		 ORDER BY tg.name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var tag string
+		if err := rows.Scan(&id, &tag); err != nil {
+			return nil, err
+		}
+		if r, ok := byId[id]; ok {
+			r.AddTags = append(r.AddTags, tag)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, r := range rules {
+		// Rules are validated when saved, a pattern that no longer compiles
+		// disables the rule rather than breaking syncs
+		if r.Pattern != "" {
+			if r.re, err = regexp.Compile(r.Pattern); err != nil {
+				r.Disabled = true
+			}
+		}
+	}
+
+	return rules, nil
+}
+
+// tagId returns the id of the tag called name, creating it if needed
+func tagId(ctx context.Context, q queryer, name string) (int, error) {
+	_, err := q.ExecContext(ctx, `INSERT INTO tags (name) VALUES ($1) ON CONFLICT (name) DO NOTHING`, name)
+	if err != nil {
+		return 0, err
+	}
+
+	var id int
+	err = q.QueryRowContext(ctx, `SELECT id FROM tags WHERE name=$1`, name).Scan(&id)
+
+	return id, err
+}
+
+// normalizeTags trims tags and drops empty and duplicate ones
+func normalizeTags(tags []string) []string {
+	var out []string
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag != "" && !containsString(out, tag) {
+			out = append(out, tag)
+		}
+	}
+
+	return out
+}
+
+// SaveRule creates r if it has no id, otherwise updates it. The id of a new
+// rule is set on r. Rules only affect transactions synced afterwards until
+// they are applied with ApplyRules.
+func (db *DB) SaveRule(ctx context.Context, r *Rule) error {
+	r.AddTags = normalizeTags(r.AddTags)
+	if err := r.compile(); err != nil {
+		return err
+	}
+
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if r.SetCategoryId != nil {
+		var n int
+		err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM categories WHERE id=$1`, *r.SetCategoryId).Scan(&n)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return errUnknownCategory
+		}
+	}
+
+	args := []any{
+		r.Name, r.Priority, r.Disabled, r.Merchant, r.Pattern, r.MinAmount, r.MaxAmount,
+		r.AccountId, r.PlaidCategory, r.SetCategoryId, r.RenameMerchant, r.MarkTransfer, r.Hide,
+	}
+	if r.Id == 0 {
+		res, err := tx.ExecContext(
+			ctx,
+			`INSERT INTO rules
+				(name, priority, disabled, merchant, pattern, min_amount, max_amount,
+				 plaid_account_id, plaid_category, set_category_id, rename_merchant, mark_transfer, hide)
+			 VALUES ($1, $2, $3, NULLIF($4, ''), NULLIF($5, ''), $6, $7,
+				 NULLIF($8, ''), NULLIF($9, ''), $10, NULLIF($11, ''), $12, $13)`, args...)
+		if err != nil {
+			return err
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		r.Id = int(id)
+	} else {
+		res, err := tx.ExecContext(
+			ctx,
+			`UPDATE rules
+				SET name=$1, priority=$2, disabled=$3, merchant=NULLIF($4, ''), pattern=NULLIF($5, ''),
+					min_amount=$6, max_amount=$7, plaid_account_id=NULLIF($8, ''),
+					plaid_category=NULLIF($9, ''), set_category_id=$10,
+					rename_merchant=NULLIF($11, ''), mark_transfer=$12, hide=$13
+			 WHERE id=$14`, append(args, r.Id)...)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return errUnknownRule
+		}
+		if _, err = tx.ExecContext(ctx, `DELETE FROM rule_tags WHERE rule_id=$1`, r.Id); err != nil {
+			return err
+		}
+	}
+
+	for _, tag := range r.AddTags {
+		id, err := tagId(ctx, tx, tag)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `INSERT INTO rule_tags (rule_id, tag_id) VALUES ($1, $2)`, r.Id, id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// DeleteRule removes a rule. What it already did to transactions stays until
+// rules are next applied.
+func (db *DB) DeleteRule(ctx context.Context, id int) error {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.ExecContext(ctx, `DELETE FROM rule_tags WHERE rule_id=$1`, id); err != nil {
+		return err
+	}
+	res, err := tx.ExecContext(ctx, `DELETE FROM rules WHERE id=$1`, id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errUnknownRule
+	}
+
+	return tx.Commit()
+}
+
+// ruleSubjectsSQL selects the columns scanned by scanRuleSubjects
+const ruleSubjectsSQL = `
+SELECT plaid_transaction_id, plaid_account_id, date, COALESCE(merchant_name, ''), name, amount,
+	COALESCE(category, ''), COALESCE(category_detailed, '')
+FROM transactions`
+
+func scanRuleSubjects(rows *sql.Rows) ([]*ruleSubject, error) {
+	defer rows.Close()
+
+	var subjects []*ruleSubject
+	for rows.Next() {
+		s := new(ruleSubject)
+		err := rows.Scan(
+			&s.PlaidTransactionId, &s.PlaidAccountId, &s.Date, &s.MerchantName, &s.Name, &s.Amount,
+			&s.Category, &s.CategoryDetailed)
+		if err != nil {
+			return nil, err
+		}
+		subjects = append(subjects, s)
+	}
+
+	return subjects, rows.Err()
+}
+
+// storeRuleOutcome replaces what rules previously did to a transaction with
+// out, which may be nil if no rules match any more.
+func storeRuleOutcome(ctx context.Context, q queryer, plaidTransactionId string, out *RuleOutcome) error {
+	_, err := q.ExecContext(ctx, `DELETE FROM rule_results WHERE plaid_transaction_id=$1`, plaidTransactionId)
+	if err != nil {
+		return err
+	}
+	_, err = q.ExecContext(
+		ctx,
+		`DELETE FROM transaction_tags WHERE plaid_transaction_id=$1 AND added_by_rule`, plaidTransactionId)
+	if err != nil {
+		return err
+	}
+	if out == nil {
+		return nil
+	}
+
+	_, err = q.ExecContext(
+		ctx,
+		`INSERT INTO rule_results (plaid_transaction_id, category_id, merchant_name, transfer, hidden)
+		 VALUES ($1, $2, NULLIF($3, ''), $4, $5)`,
+		plaidTransactionId, out.CategoryId, out.MerchantName, out.Transfer, out.Hidden)
+	if err != nil {
+		return err
+	}
+	for _, tag := range out.Tags {
+		id, err := tagId(ctx, q, tag)
+		if err != nil {
+			return err
+		}
+		// A tag added by hand takes precedence and stays if the rule stops matching
+		_, err = q.ExecContext(
+			ctx,
+			`INSERT INTO transaction_tags (plaid_transaction_id, tag_id, added_by_rule)
+			 VALUES ($1, $2, 1)
+			 ON CONFLICT (plaid_transaction_id, tag_id) DO NOTHING`, plaidTransactionId, id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// applyRulesTo runs the rules over the given transactions as part of a sync
+func applyRulesTo(ctx context.Context, q queryer, rules []*Rule, plaidTransactionIds []string) error {
+	for _, id := range plaidTransactionIds {
+		rows, err := q.QueryContext(ctx, ruleSubjectsSQL+` WHERE plaid_transaction_id=$1`, id)
+		if err != nil {
+			return err
+		}
+		subjects, err := scanRuleSubjects(rows)
+		if err != nil {
+			return err
+		}
+		for _, s := range subjects {
+			if err = storeRuleOutcome(ctx, q, s.PlaidTransactionId, evaluateRules(rules, s)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// RuleChange is a transaction whose rule outcome changes when rules are
+// applied
+type RuleChange struct {
+	TransactionId string       `json:"transaction_id"`
+	Date          string       `json:"date"`
+	Name          string       `json:"name"`
+	Amount        float64      `json:"amount"`
+	Before        *RuleOutcome `json:"before"`
+	After         *RuleOutcome `json:"after"`
+}
+
+// ApplyRules reruns every rule over all existing transactions and returns the
+// transactions whose outcome changed. With dryRun nothing is written.
+// Manual category overrides and tags are untouched, and still win.
+func (db *DB) ApplyRules(ctx context.Context, dryRun bool) ([]*RuleChange, error) {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rules, err := loadRules(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+	current, err := loadRuleOutcomes(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+	handTags, err := loadHandTags(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := tx.QueryContext(ctx, ruleSubjectsSQL+` WHERE deleted_at IS NULL ORDER BY date DESC, id DESC`)
+	if err != nil {
+		return nil, err
+	}
+	subjects, err := scanRuleSubjects(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []*RuleChange
+	for _, s := range subjects {
+		before, after := current[s.PlaidTransactionId], evaluateRules(rules, s)
+		if after != nil {
+			// A rule never owns a tag that was added by hand, so it is never
+			// stored as the rule's and must not count as a change
+			after.Tags = withoutTags(after.Tags, handTags[s.PlaidTransactionId])
+		}
+		if reflect.DeepEqual(before, after) {
+			continue
+		}
+		changes = append(changes, &RuleChange{
+			TransactionId: s.PlaidTransactionId,
+			Date:          s.Date,
+			Name:          s.Name,
+			Amount:        s.Amount,
+			Before:        before,
+			After:         after,
+		})
+		if !dryRun {
+			if err = storeRuleOutcome(ctx, tx, s.PlaidTransactionId, after); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if dryRun {
+		return changes, nil
+	}
+
+	return changes, tx.Commit()
+}
+
+// loadRuleOutcomes returns the stored rule outcome of every transaction that
+// has one, keyed by Plaid transaction id
+func loadRuleOutcomes(ctx context.Context, q queryer) (map[string]*RuleOutcome, error) {
+	rows, err := q.QueryContext(
+		ctx,
+		`SELECT plaid_transaction_id, category_id, COALESCE(merchant_name, ''), transfer, hidden
+		 FROM rule_results`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	outcomes := make(map[string]*RuleOutcome)
+	for rows.Next() {
+		var id string
+		out := new(RuleOutcome)
+		if err := rows.Scan(&id, &out.CategoryId, &out.MerchantName, &out.Transfer, &out.Hidden); err != nil {
+			return nil, err
+		}
+		outcomes[id] = out
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	rows, err = q.QueryContext(
+		ctx,
+		`SELECT tt.plaid_transaction_id, tg.name
+		 FROM transaction_tags tt
+		 JOIN tags tg ON tg.id=tt.tag_id
+		 WHERE tt.added_by_rule
+		 ORDER BY tg.name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, tag string
+		if err := rows.Scan(&id, &tag); err != nil {
+			return nil, err
+		}
+		if out, ok := outcomes[id]; ok {
+			out.Tags = append(out.Tags, tag)
+		}
+	}
+
+	return outcomes, rows.Err()
+}
+
+// loadHandTags returns the names of the tags added by hand to each
+// transaction, keyed by Plaid transaction id
+func loadHandTags(ctx context.Context, q queryer) (map[string]map[string]bool, error) {
+	rows, err := q.QueryContext(
+		ctx,
+		`SELECT tt.plaid_transaction_id, tg.name
+		 FROM transaction_tags tt
+		 JOIN tags tg ON tg.id=tt.tag_id
+		 WHERE NOT tt.added_by_rule`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := make(map[string]map[string]bool)
+	for rows.Next() {
+		var id, tag string
+		if err := rows.Scan(&id, &tag); err != nil {
+			return nil, err
+		}
+		if tags[id] == nil {
+			tags[id] = make(map[string]bool)
+		}
+		tags[id][tag] = true
+	}
+
+	return tags, rows.Err()
+}
+
+// withoutTags returns tags less any in drop, or nil if none are left
+func withoutTags(tags []string, drop map[string]bool) []string {
+	var kept []string
+	for _, tag := range tags {
+		if !drop[tag] {
+			kept = append(kept, tag)
+		}
+	}
+
+	return kept
+}
+
+// statusForRuleError maps errors from changing rules to HTTP statuses
+func statusForRuleError(err error) int {
+	switch {
+	case errors.Is(err, errUnknownRule):
+		return http.StatusNotFound
+	case errors.Is(err, errUnknownCategory), errors.Is(err, errRuleNoCondition),
+		errors.Is(err, errRuleNoAction), errors.Is(err, errRuleBadPattern):
+		return http.StatusBadRequest
+	}
+
+	return http.StatusInternalServerError
+}
+
+// rules lists rules on GET, and creates or updates one on POST
+func (srv *Server) rules() http.HandlerFunc {
+	type response struct {
+		ErrorMsg string  `json:",omitempty"`
+		Rules    []*Rule `json:"rules,omitempty"`
+		Rule     *Rule   `json:"rule,omitempty"`
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		var resp response
+
+		switch req.Method {
+		case http.MethodGet:
+			rules, err := srv.db.RetrieveRules(req.Context())
+			if err != nil {
+				resp.ErrorMsg = err.Error()
+				returnJSON(w, http.StatusInternalServerError, resp)
+				return
+			}
+			resp.Rules = rules
+			if resp.Rules == nil {
+				resp.Rules = []*Rule{}
+			}
+		case http.MethodPost:
+			r := new(Rule)
+			if err := json.NewDecoder(req.Body).Decode(r); err != nil {
+				resp.ErrorMsg = err.Error()
+				returnJSON(w, http.StatusBadRequest, resp)
+				return
+			}
+			if err := srv.db.SaveRule(req.Context(), r); err != nil {
+				resp.ErrorMsg = err.Error()
+				returnJSON(w, statusForRuleError(err), resp)
+				return
+			}
+			resp.Rule = r
+		default:
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+
+		returnJSON(w, http.StatusOK, resp)
+	}
+}
+
+func (srv *Server) deleteRule() http.HandlerFunc {
+	type payload struct {
+		Id int `json:"id"`
+	}
+
+	type response struct {
+		ErrorMsg string `json:",omitempty"`
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+
+		var resp response
+
+		pay := payload{}
+		if err := json.NewDecoder(req.Body).Decode(&pay); err != nil {
+			resp.ErrorMsg = err.Error()
+			returnJSON(w, http.StatusBadRequest, resp)
+			return
+		}
+		if err := srv.db.DeleteRule(req.Context(), pay.Id); err != nil {
+			resp.ErrorMsg = err.Error()
+			returnJSON(w, statusForRuleError(err), resp)
+			return
+		}
+
+		returnJSON(w, http.StatusOK, resp)
+	}
+}
+
+// applyRules reruns the rules over all transactions. With dry_run the changes
+// are only previewed.
+func (srv *Server) applyRules() http.HandlerFunc {
+	type payload struct {
+		DryRun bool `json:"dry_run"`
+	}
+
+	type response struct {
+		ErrorMsg string        `json:",omitempty"`
+		DryRun   bool          `json:"dry_run"`
+		Changes  []*RuleChange `json:"changes"`
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+
+		var resp response
+
+		pay := payload{}
+		if err := json.NewDecoder(req.Body).Decode(&pay); err != nil {
+			resp.ErrorMsg = err.Error()
+			returnJSON(w, http.StatusBadRequest, resp)
+			return
+		}
+		resp.DryRun = pay.DryRun
+
+		changes, err := srv.db.ApplyRules(req.Context(), pay.DryRun)
+		if err != nil {
+			resp.ErrorMsg = err.Error()
+			returnJSON(w, http.StatusInternalServerError, resp)
+			return
+		}
+		resp.Changes = changes
+		if resp.Changes == nil {
+			resp.Changes = []*RuleChange{}
+		}
+
+		returnJSON(w, http.StatusOK, resp)
+	}
+}
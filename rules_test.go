@@ -0,0 +1,136 @@
+package expenses
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/plaid/plaid-go/v12/plaid"
+)
+
+func TestEvaluateRules(t *testing.T) {
+	groceries, household := 1, 2
+	min := 50.0
+	rules := []*Rule{
+		{Id: 1, Merchant: "safeway", SetCategoryId: &groceries, AddTags: []string{"food"}},
+		{Id: 2, Pattern: `^SAFEWAY #\d+`, MinAmount: &min, SetCategoryId: &household, AddTags: []string{"big", "food"}},
+		{Id: 3, AccountId: "a2", Hide: true},
+		{Id: 4, Merchant: "safeway", RenameMerchant: "Disabled", Disabled: true},
+	}
+	for _, r := range rules {
+		if err := r.compile(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	subject := &ruleSubject{PlaidAccountId: "a1", MerchantName: "Safeway", Name: "SAFEWAY #123", Amount: 75}
+	out := evaluateRules(rules, subject)
+	if out == nil || *out.CategoryId != groceries {
+		t.Fatalf("got %+v, want the category of the first matching rule", out)
+	}
+	if len(out.Tags) != 2 || out.Tags[0] != "big" || out.Tags[1] != "food" {
+		t.Errorf("got tags %v, want [big food]", out.Tags)
+	}
+	if out.Hidden || out.MerchantName != "" {
+		t.Errorf("got %+v, non-matching and disabled rules applied", out)
+	}
+
+	if out := evaluateRules(rules, &ruleSubject{PlaidAccountId: "a1", Name: "Costco"}); out != nil {
+		t.Errorf("got %+v, want no rules to match", out)
+	}
+
+	if err := (&Rule{Pattern: "(", Hide: true}).compile(); !errors.Is(err, errRuleBadPattern) {
+		t.Errorf("got %v compiling a bad pattern, want %v", err, errRuleBadPattern)
+	}
+	if err := (&Rule{Hide: true}).compile(); !errors.Is(err, errRuleNoCondition) {
+		t.Errorf("got %v for a rule without conditions, want %v", err, errRuleNoCondition)
+	}
+}
+
+func TestApplyRules(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+
+	added := []plaid.Transaction{
+		testTransaction("t1", "a1", "2023-06-01", "Netflix", 15.99),
+		testTransaction("t2", "a1", "2023-06-02", "Safeway", 30),
+	}
+	if _, err := db.UpdatePlaidTransactions(ctx, added, nil, nil, "item1", "c1"); err != nil {
+		t.Fatal(err)
+	}
+
+	rule := &Rule{Name: "Streaming", Merchant: "netflix", RenameMerchant: "Netflix Inc", AddTags: []string{"subscription"}}
+	if err := db.SaveRule(ctx, rule); err != nil {
+		t.Fatal(err)
+	}
+
+	// Existing transactions are only changed when rules are applied
+	changes, err := db.ApplyRules(ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].TransactionId != "t1" || changes[0].Before != nil {
+		t.Fatalf("dry run got changes %+v, want only t1", changes)
+	}
+	merchants := func() map[string]string {
+		t.Helper()
+		txns, err := db.QueryTransactions(ctx, TransactionFilter{IncludeHidden: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make(map[string]string)
+		for _, txn := range txns {
+			got[txn.PlaidTransactionId] = txn.MerchantName
+		}
+		return got
+	}
+	if got := merchants(); got["t1"] != "Netflix" {
+		t.Errorf("dry run renamed t1 to %q", got["t1"])
+	}
+
+	if _, err = db.ApplyRules(ctx, false); err != nil {
+		t.Fatal(err)
+	}
+	if got := merchants(); got["t1"] != "Netflix Inc" {
+		t.Errorf("got merchant %q for t1, want Netflix Inc", got["t1"])
+	}
+	if changes, err = db.ApplyRules(ctx, true); err != nil || len(changes) != 0 {
+		t.Errorf("got changes %+v, %v after applying, want none", changes, err)
+	}
+
+	// A tag the rule adds that was already added by hand stays the user's
+	if err := db.SetTransactionTags(ctx, "t2", []string{"groceries"}); err != nil {
+		t.Fatal(err)
+	}
+	groceries := &Rule{Name: "Groceries", Merchant: "safeway", AddTags: []string{"groceries"}}
+	if err := db.SaveRule(ctx, groceries); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.ApplyRules(ctx, false); err != nil {
+		t.Fatal(err)
+	}
+	if changes, err = db.ApplyRules(ctx, true); err != nil || len(changes) != 0 {
+		t.Errorf("got changes %+v, %v with a hand added tag, want none", changes, err)
+	}
+
+	// New transactions have rules applied as they are synced
+	limit := 100.0
+	hide := &Rule{Name: "Hide big", MinAmount: &limit, Hide: true}
+	if err := db.SaveRule(ctx, hide); err != nil {
+		t.Fatal(err)
+	}
+	added = []plaid.Transaction{testTransaction("t3", "a1", "2023-06-03", "Netflix", 150)}
+	if _, err := db.UpdatePlaidTransactions(ctx, added, nil, nil, "item1", "c2"); err != nil {
+		t.Fatal(err)
+	}
+	txns, err := db.QueryTransactions(ctx, TransactionFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txns) != 2 {
+		t.Errorf("got %d visible transactions, want 2 with t3 hidden", len(txns))
+	}
+	if got := merchants(); got["t3"] != "Netflix Inc" {
+		t.Errorf("got merchant %q for t3, want Netflix Inc", got["t3"])
+	}
+}
@@ -0,0 +1,135 @@
+package expenses
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// How often the scheduler checks for items that are due a sync
+const schedulerTick = time.Minute
+
+// scheduler periodically syncs the transactions of every item. Each item is
+// synced on its own timer, offset by a random jitter so that items don't all
+// hit Plaid at the same moment.
+type scheduler struct {
+	srv       *Server
+	interval  time.Duration
+	jitter    time.Duration
+	intervals map[string]time.Duration // per-item overrides of interval
+
+	nextRun map[string]time.Time
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+func newScheduler(srv *Server, interval, jitter time.Duration, intervals map[string]time.Duration) *scheduler {
+	return &scheduler{
+		srv:       srv,
+		interval:  interval,
+		jitter:    jitter,
+		intervals: intervals,
+		nextRun:   make(map[string]time.Time),
+	}
+}
+
+func (s *scheduler) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		ticker := time.NewTicker(schedulerTick)
+		defer ticker.Stop()
+
+		for {
+			s.runDue(ctx, time.Now())
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// stop cancels in flight syncs and waits for them to finish.
+func (s *scheduler) stop() {
+	if s.cancel == nil {
+		return
+	}
+	s.cancel()
+	s.wg.Wait()
+}
+
+func (s *scheduler) itemInterval(itemId string) time.Duration {
+	if interval, ok := s.intervals[itemId]; ok && interval > 0 {
+		return interval
+	}
+
+	return s.interval
+}
+
+func (s *scheduler) randJitter() time.Duration {
+	if s.jitter <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(s.jitter)))
+}
+
+// runDue starts a sync for every item whose next run time has passed.
+func (s *scheduler) runDue(ctx context.Context, now time.Time) {
+	items, err := s.srv.db.RetrieveItems(ctx)
+	if err != nil {
+		log.Printf("Scheduler failed to retrieve items: %v", err)
+		return
+	}
+
+	// Forget items that have been removed
+	current := make(map[string]bool, len(items))
+	for _, item := range items {
+		current[item.PlaidItemId] = true
+	}
+	for itemId := range s.nextRun {
+		if !current[itemId] {
+			delete(s.nextRun, itemId)
+		}
+	}
+
+	for _, item := range items {
+		next, ok := s.nextRun[item.PlaidItemId]
+		if !ok {
+			// First time the item has been seen, spread out the initial syncs
+			s.nextRun[item.PlaidItemId] = now.Add(s.randJitter())
+			continue
+		}
+		if now.Before(next) {
+			continue
+		}
+
+		s.nextRun[item.PlaidItemId] = now.Add(s.itemInterval(item.PlaidItemId) + s.randJitter())
+
+		s.wg.Add(1)
+		go func(item *Item) {
+			defer s.wg.Done()
+
+			res, err := s.srv.syncItem(ctx, item)
+			switch {
+			case errors.Is(err, errSyncInProgress):
+				log.Printf("Scheduled sync of item %s skipped, already syncing", item.PlaidItemId)
+			case err != nil:
+				log.Printf("Scheduled sync of item %s failed: %v", item.PlaidItemId, err)
+			default:
+				log.Printf("Scheduled sync of item %s: %d added, %d modified, %d removed",
+					item.PlaidItemId, res.Added, res.Modified, res.Removed)
+			}
+		}(item)
+	}
+}
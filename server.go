@@ -5,30 +5,86 @@ import (
 	"embed"
 	"encoding/json"
 	"fmt"
+	"html/template"
 	"log"
 	"net/http"
+	"net/url"
+	"sort"
 	"strconv"
-	"text/template"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/plaid/plaid-go/v12/plaid"
 )
 
 type Server struct {
-	client *plaid.APIClient
-	db     *DB
-	s      *http.Server
-	mux    *http.ServeMux
-
-	certFile, keyFile string
+	client    *plaid.APIClient
+	db        *DB
+	s         *http.Server
+	mux       *http.ServeMux
+	scheduler *scheduler
+	syncing   itemLocks
+	webhooks  *webhookVerifier
+
+	plaidRecurring plaidRecurringCache
+
+	// Background work started by requests, cancelled on Shutdown
+	bgCtx    context.Context
+	bgCancel context.CancelFunc
+	bg       sync.WaitGroup
+
+	certFile, keyFile     string
+	webhookURL            string
+	retainHistoryOnRemove bool
+	plaidRecurringEnabled bool
 }
 
 var (
 	//go:embed tmpl/*.html
 	embeddedFS embed.FS
 
-	indexTmpl *template.Template
+	indexTmpl        *template.Template
+	netWorthTmpl     *template.Template
+	transactionsTmpl *template.Template
+	budgetsTmpl      *template.Template
+	reportsTmpl      *template.Template
+	transfersTmpl    *template.Template
+	recurringTmpl    *template.Template
+
+	tmplFuncs = template.FuncMap{
+		"money":    func(v float64) string { return strconv.FormatFloat(v, 'f', 2, 64) },
+		"deref":    func(v *float64) float64 { return *v },
+		"derefInt": func(v *int) int { return *v },
+		"join":     strings.Join,
+		// percent formats a fraction as a signed percentage
+		"percent": func(v float64) string { return fmt.Sprintf("%+.0f%%", v*100) },
+		// Institution logos are stored as base64 encoded PNGs
+		"logo": func(b64 string) template.URL { return template.URL("data:image/png;base64," + b64) },
+		// sortQuery returns the query string that sorts by col, toggling
+		// the direction if already sorted by col
+		"sortQuery": func(q url.Values, col string) string {
+			sorted := url.Values{}
+			for k, v := range q {
+				if k != "cursor" {
+					sorted[k] = v
+				}
+			}
+			dir := "desc"
+			if q.Get("sort") == col && q.Get("dir") != "asc" {
+				dir = "asc"
+			}
+			sorted.Set("sort", col)
+			sorted.Set("dir", dir)
+			return sorted.Encode()
+		},
+	}
 )
 
+func parseTemplate(name string) *template.Template {
+	return template.Must(template.New(name).Funcs(tmplFuncs).ParseFS(embeddedFS, "tmpl/"+name))
+}
+
 type LoggingMux struct {
 	handler http.Handler
 	logger  *log.Logger
@@ -59,45 +115,246 @@ func NewLoggingResponseWriter(w http.ResponseWriter) *LoggingResponseWriter {
 }
 
 func init() {
-	indexTmpl = template.Must(template.ParseFS(embeddedFS, "tmpl/index.html"))
+	indexTmpl = parseTemplate("index.html")
+	netWorthTmpl = parseTemplate("networth.html")
+	transactionsTmpl = parseTemplate("transactions.html")
+	budgetsTmpl = parseTemplate("budgets.html")
+	reportsTmpl = parseTemplate("reports.html")
+	transfersTmpl = parseTemplate("transfers.html")
+	recurringTmpl = parseTemplate("recurring.html")
 }
 
-func NewServer(client *plaid.APIClient, db *DB, port int, certFile, keyFile string) *Server {
+func NewServer(client *plaid.APIClient, db *DB, config *AppConfig) *Server {
 	srv := &Server{
-		client:   client,
-		db:       db,
-		certFile: certFile,
-		keyFile:  keyFile,
+		client:     client,
+		db:         db,
+		webhooks:   newWebhookVerifier(client),
+		certFile:   config.TLSCertFile,
+		keyFile:    config.TLSKeyFile,
+		webhookURL: config.WebhookURL,
+
+		retainHistoryOnRemove: config.RetainHistoryOnRemove,
+		plaidRecurringEnabled: config.PlaidRecurring,
+	}
+	srv.bgCtx, srv.bgCancel = context.WithCancel(context.Background())
+	if config.SyncInterval > 0 {
+		srv.scheduler = newScheduler(srv, config.SyncInterval, config.SyncJitter, config.SyncItemIntervals)
 	}
 	mux := http.NewServeMux()
 	mux.Handle("/get_access_token", srv.getAccessToken())
 	mux.Handle("/create_link_token", srv.createLinkToken())
+	mux.Handle("/create_update_link_token", srv.createUpdateLinkToken())
+	mux.Handle("/item_repaired", srv.itemRepaired())
 	mux.Handle("/admin/institutions/refresh", srv.refreshInstitutions())
 	mux.Handle("/admin/transactions/sync", srv.syncTransactions())
+	mux.Handle("/admin/items/remove", srv.removeItem())
+	mux.Handle("/admin/accounts/refresh", srv.refreshAccounts())
+	mux.Handle("/webhooks/plaid", srv.plaidWebhook())
+	mux.Handle("/api/items", srv.listItems())
+	mux.Handle("/api/networth", srv.netWorthAPI())
+	mux.Handle("/api/reports", srv.reports())
+	mux.Handle("/api/reports/categories", srv.spendingByCategory())
+	mux.Handle("/api/reports/cashflow", srv.cashFlow())
+	mux.Handle("/api/transactions", srv.listTransactions())
+	mux.Handle("/api/transactions/category", srv.setTransactionCategory())
+	mux.Handle("/api/transactions/kind", srv.setTransactionKind())
+	mux.Handle("/api/transactions/tags", srv.setTransactionTags())
+	mux.Handle("/api/transactions/note", srv.setTransactionNote())
+	mux.Handle("/api/transactions/splits", srv.setTransactionSplits())
+	mux.Handle("/api/tags", srv.listTags())
+	mux.Handle("/api/transfers", srv.transferPairs())
+	mux.Handle("/api/transfers/match", srv.matchTransfers())
+	mux.Handle("/api/transfers/review", srv.reviewTransferPair())
+	mux.Handle("/api/budgets", srv.budgets())
+	mux.Handle("/api/budgets/delete", srv.deleteBudget())
+	mux.Handle("/api/categories", srv.categories())
+	mux.Handle("/api/categories/delete", srv.deleteCategory())
+	mux.Handle("/api/categories/mappings", srv.categoryMappings())
+	mux.Handle("/api/recurring", srv.listRecurring())
+	mux.Handle("/api/rules", srv.rules())
+	mux.Handle("/api/rules/delete", srv.deleteRule())
+	mux.Handle("/api/rules/apply", srv.applyRules())
+	mux.Handle("/networth", srv.netWorthPage())
+	mux.Handle("/transactions", srv.transactionsPage())
+	mux.Handle("/budgets", srv.budgetsPage())
+	mux.Handle("/reports", srv.reportsPage())
+	mux.Handle("/transfers", srv.transfersPage())
+	mux.Handle("/recurring", srv.recurringPage())
 	mux.Handle("/static/", http.FileServer(http.Dir("")))
 	mux.Handle("/", srv.serveRoot())
 
 	srv.mux = mux
 	srv.s = &http.Server{
-		Addr:    fmt.Sprintf(":%d", port),
+		Addr:    fmt.Sprintf(":%d", config.ServerPort),
 		Handler: &LoggingMux{srv.mux, log.Default()},
 	}
 
 	return srv
 }
 
+// serveRoot renders an overview of every linked institution with its items
+// and their accounts
 func (srv *Server) serveRoot() http.HandlerFunc {
+	type page struct {
+		ErrorMsg     string
+		Institutions []*institutionOverview
+	}
+
 	return func(w http.ResponseWriter, req *http.Request) {
-		if req.Method == http.MethodGet {
-			items, _ := srv.db.RetrieveItems(req.Context())
-			indexTmpl.Execute(w, items)
+		if req.Method != http.MethodGet {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 			return
 		}
 
-		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		var p page
+		status := http.StatusOK
+		institutions, err := srv.overview(req.Context())
+		if err != nil {
+			p.ErrorMsg = err.Error()
+			status = http.StatusInternalServerError
+		}
+		p.Institutions = institutions
+
+		w.WriteHeader(status)
+		if err := indexTmpl.Execute(w, p); err != nil {
+			log.Printf("Failed to render index: %v", err)
+		}
 	}
 }
 
+type itemOverview struct {
+	*Item
+	Accounts []*Account
+}
+
+type institutionOverview struct {
+	*Institution
+	Items []*itemOverview
+}
+
+// overview groups every item, with its accounts, by institution. Institutions
+// that haven't been refreshed yet are named by their Plaid id.
+func (srv *Server) overview(ctx context.Context) ([]*institutionOverview, error) {
+	items, err := srv.db.RetrieveItems(ctx)
+	if err != nil {
+		return nil, err
+	}
+	accounts, err := srv.db.RetrieveAccounts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	institutions, err := srv.db.RetrieveInstitutions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	byItem := make(map[string][]*Account)
+	for _, acct := range accounts {
+		byItem[acct.PlaidItemId] = append(byItem[acct.PlaidItemId], acct)
+	}
+
+	var overview []*institutionOverview
+	byId := make(map[string]*institutionOverview)
+	for _, inst := range institutions {
+		byId[inst.PlaidInstitutionId] = &institutionOverview{Institution: inst}
+	}
+	for _, item := range items {
+		inst, ok := byId[item.PlaidInstitutionId]
+		if !ok {
+			inst = &institutionOverview{Institution: &Institution{
+				PlaidInstitutionId: item.PlaidInstitutionId,
+				Name:               item.PlaidInstitutionId,
+			}}
+			byId[item.PlaidInstitutionId] = inst
+		}
+		if len(inst.Items) == 0 {
+			overview = append(overview, inst)
+		}
+		inst.Items = append(inst.Items, &itemOverview{Item: item, Accounts: byItem[item.PlaidItemId]})
+	}
+	sort.Slice(overview, func(i, j int) bool {
+		return overview[i].Name < overview[j].Name
+	})
+
+	return overview, nil
+}
+
+// listItems reports the health of every linked item
+func (srv *Server) listItems() http.HandlerFunc {
+	type item struct {
+		ItemId              string     `json:"item_id"`
+		InstitutionId       string     `json:"institution_id"`
+		Institution         string     `json:"institution"`
+		Status              string     `json:"status"`
+		NeedsAttention      bool       `json:"needs_attention"`
+		LastSyncedAt        *time.Time `json:"last_synced_at"`
+		LastErrorCode       string     `json:"last_error_code,omitempty"`
+		LastErrorMessage    string     `json:"last_error_message,omitempty"`
+		ConsecutiveFailures int        `json:"consecutive_failures"`
+	}
+
+	type response struct {
+		ErrorMsg string `json:",omitempty"`
+		Items    []item `json:"items"`
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+
+		var resp response
+
+		items, err := srv.db.RetrieveItems(req.Context())
+		if err != nil {
+			resp.ErrorMsg = err.Error()
+			returnJSON(w, http.StatusInternalServerError, resp)
+			return
+		}
+
+		resp.Items = make([]item, len(items))
+		for i, it := range items {
+			resp.Items[i] = item{
+				ItemId:              it.PlaidItemId,
+				InstitutionId:       it.PlaidInstitutionId,
+				Status:              it.Status,
+				NeedsAttention:      it.NeedsAttention(),
+				LastSyncedAt:        it.LastSyncedAt,
+				LastErrorCode:       it.LastErrorCode,
+				LastErrorMessage:    it.LastErrorMessage,
+				ConsecutiveFailures: it.ConsecutiveFailures,
+			}
+
+			institution, err := srv.db.RetrieveInstitutionById(req.Context(), it.PlaidInstitutionId)
+			if err != nil {
+				resp.ErrorMsg = err.Error()
+				returnJSON(w, http.StatusInternalServerError, resp)
+				return
+			}
+			if institution != nil {
+				resp.Items[i].Institution = institution.Name
+			}
+		}
+
+		returnJSON(w, http.StatusOK, resp)
+	}
+}
+
+func (srv *Server) newLinkTokenRequest() *plaid.LinkTokenCreateRequest {
+	user := plaid.LinkTokenCreateRequestUser{ClientUserId: "1"}
+	ltcreq := plaid.NewLinkTokenCreateRequest(
+		"Expense Tracker",
+		"en",
+		[]plaid.CountryCode{plaid.COUNTRYCODE_US},
+		user)
+	if srv.webhookURL != "" {
+		ltcreq.SetWebhook(srv.webhookURL)
+	}
+
+	return ltcreq
+}
+
 func (srv *Server) createLinkToken() http.HandlerFunc {
 	type response struct {
 		ErrorMsg  string `json:",omitempty"`
@@ -112,12 +369,7 @@ func (srv *Server) createLinkToken() http.HandlerFunc {
 
 		var resp response
 
-		user := plaid.LinkTokenCreateRequestUser{ClientUserId: "1"}
-		ltcreq := plaid.NewLinkTokenCreateRequest(
-			"Expense Tracker",
-			"en",
-			[]plaid.CountryCode{plaid.COUNTRYCODE_US},
-			user)
+		ltcreq := srv.newLinkTokenRequest()
 		ltcreq.SetProducts([]plaid.Products{plaid.PRODUCTS_TRANSACTIONS})
 		ltcres, _, err := srv.client.PlaidApi.LinkTokenCreate(req.Context()).LinkTokenCreateRequest(*ltcreq).Execute()
 		if err != nil {
@@ -131,6 +383,115 @@ func (srv *Server) createLinkToken() http.HandlerFunc {
 	}
 }
 
+// createUpdateLinkToken creates a link token that launches Link in update mode
+// so the user can re-authenticate an existing item.
+func (srv *Server) createUpdateLinkToken() http.HandlerFunc {
+	type payload struct {
+		ItemId string `json:"item_id"`
+	}
+
+	type response struct {
+		ErrorMsg  string `json:",omitempty"`
+		LinkToken string `json:",omitempty"`
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+
+		var resp response
+
+		pay := payload{}
+		if err := json.NewDecoder(req.Body).Decode(&pay); err != nil {
+			resp.ErrorMsg = err.Error()
+			returnJSON(w, http.StatusBadRequest, resp)
+			return
+		}
+
+		item, err := srv.db.RetrieveItemByPlaidItemId(req.Context(), pay.ItemId)
+		if err != nil {
+			resp.ErrorMsg = err.Error()
+			returnJSON(w, http.StatusInternalServerError, resp)
+			return
+		}
+		if item == nil {
+			resp.ErrorMsg = "Unknown item"
+			returnJSON(w, http.StatusNotFound, resp)
+			return
+		}
+
+		// Update mode is selected by passing the item's access token, products
+		// must not be set
+		ltcreq := srv.newLinkTokenRequest()
+		ltcreq.SetAccessToken(item.AccessToken)
+		ltcres, _, err := srv.client.PlaidApi.LinkTokenCreate(req.Context()).LinkTokenCreateRequest(*ltcreq).Execute()
+		if err != nil {
+			resp.ErrorMsg = err.Error()
+			returnJSON(w, http.StatusBadRequest, resp)
+			return
+		}
+
+		resp.LinkToken = ltcres.LinkToken
+		returnJSON(w, http.StatusCreated, resp)
+	}
+}
+
+// itemRepaired is called by the front end after update mode Link succeeds. It
+// clears the item's error state and kicks off a sync.
+func (srv *Server) itemRepaired() http.HandlerFunc {
+	type payload struct {
+		ItemId string `json:"item_id"`
+	}
+
+	type response struct {
+		ErrorMsg string `json:",omitempty"`
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+
+		var resp response
+
+		pay := payload{}
+		if err := json.NewDecoder(req.Body).Decode(&pay); err != nil {
+			resp.ErrorMsg = err.Error()
+			returnJSON(w, http.StatusBadRequest, resp)
+			return
+		}
+
+		item, err := srv.db.RetrieveItemByPlaidItemId(req.Context(), pay.ItemId)
+		if err != nil {
+			resp.ErrorMsg = err.Error()
+			returnJSON(w, http.StatusInternalServerError, resp)
+			return
+		}
+		if item == nil {
+			resp.ErrorMsg = "Unknown item"
+			returnJSON(w, http.StatusNotFound, resp)
+			return
+		}
+
+		if err = srv.db.ClearItemError(req.Context(), item.PlaidItemId); err != nil {
+			resp.ErrorMsg = err.Error()
+			returnJSON(w, http.StatusInternalServerError, resp)
+			return
+		}
+
+		srv.runInBackground(func(ctx context.Context) {
+			if _, err := srv.syncItem(ctx, item); err != nil {
+				log.Printf("Sync of repaired item %s failed: %v", item.PlaidItemId, err)
+			}
+		})
+
+		returnJSON(w, http.StatusOK, resp)
+	}
+}
+
 func (srv *Server) getAccessToken() http.HandlerFunc {
 	type account struct {
 		Id      string
@@ -181,6 +542,23 @@ func (srv *Server) getAccessToken() http.HandlerFunc {
 		// 	return
 		// }
 
+		// Exchange the public token for a private access token with the Plaid API
+		ptereq := plaid.NewItemPublicTokenExchangeRequest(pay.PublicToken)
+		pteres, _, err := srv.client.PlaidApi.ItemPublicTokenExchange(req.Context()).ItemPublicTokenExchangeRequest(*ptereq).Execute()
+		if err != nil {
+			resp.ErrorMsg = err.Error()
+			returnJSON(w, http.StatusBadRequest, resp)
+			return
+		}
+
+		// Exchange successful, store the result in the DB
+		err = srv.db.CreateNewItem(req.Context(), pteres.ItemId, pteres.AccessToken, pay.Institution.Id)
+		if err != nil {
+			resp.ErrorMsg = err.Error()
+			returnJSON(w, http.StatusInternalServerError, resp)
+			return
+		}
+
 		// Insert all the returned accounts
 		dba := make([]Account, len(pay.Accounts))
 		for i, acct := range pay.Accounts {
@@ -188,28 +566,70 @@ func (srv *Server) getAccessToken() http.HandlerFunc {
 			dba[i].AccountMask = acct.Mask
 			dba[i].Type = acct.Type
 			dba[i].Subtype = acct.Subtype
+			dba[i].Name = acct.Name
 		}
-		err = srv.db.CreateAccounts(req.Context(), dba, pay.Institution.Id)
+		err = srv.db.CreateAccounts(req.Context(), dba, pteres.ItemId, pay.Institution.Id)
 		if err != nil {
 			resp.ErrorMsg = err.Error()
 			returnJSON(w, http.StatusInternalServerError, resp)
 			return
 		}
 
-		// No existing item, exchange public token for a private access token with the Plaid API
-		ptereq := plaid.NewItemPublicTokenExchangeRequest(pay.PublicToken)
-		pteres, _, err := srv.client.PlaidApi.ItemPublicTokenExchange(req.Context()).ItemPublicTokenExchangeRequest(*ptereq).Execute()
-		if err != nil {
+		// Link doesn't provide balances or official names
+		item := &Item{AccessToken: pteres.AccessToken, PlaidItemId: pteres.ItemId, PlaidInstitutionId: pay.Institution.Id}
+		srv.runInBackground(func(ctx context.Context) {
+			if err := srv.refreshBalances(ctx, item); err != nil {
+				log.Printf("Failed to refresh balances of item %s: %v", item.PlaidItemId, err)
+			}
+		})
+
+		returnJSON(w, http.StatusOK, resp)
+	}
+}
+
+// removeItem unlinks an item. retain_history overrides the configured
+// retain_history_on_remove.
+func (srv *Server) removeItem() http.HandlerFunc {
+	type payload struct {
+		ItemId        string `json:"item_id"`
+		RetainHistory *bool  `json:"retain_history"`
+	}
+
+	type response struct {
+		ErrorMsg string `json:",omitempty"`
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+
+		var resp response
+
+		pay := payload{}
+		if err := json.NewDecoder(req.Body).Decode(&pay); err != nil {
 			resp.ErrorMsg = err.Error()
 			returnJSON(w, http.StatusBadRequest, resp)
 			return
 		}
+		retain := srv.retainHistoryOnRemove
+		if pay.RetainHistory != nil {
+			retain = *pay.RetainHistory
+		}
 
-		// Exchange successful, store the result in the DB
-		err = srv.db.CreateNewItem(req.Context(), pteres.ItemId, pteres.AccessToken, pay.Institution.Id)
+		// Don't pull the item out from under a sync
+		if !srv.syncing.tryLock(pay.ItemId) {
+			resp.ErrorMsg = errSyncInProgress.Error()
+			returnJSON(w, http.StatusConflict, resp)
+			return
+		}
+		defer srv.syncing.unlock(pay.ItemId)
+
+		err := RemoveItem(req.Context(), srv.client, srv.db, pay.ItemId, retain)
 		if err != nil {
 			resp.ErrorMsg = err.Error()
-			returnJSON(w, http.StatusInternalServerError, resp)
+			returnJSON(w, statusForError(err), resp)
 			return
 		}
 
@@ -218,10 +638,21 @@ func (srv *Server) getAccessToken() http.HandlerFunc {
 }
 
 func (srv *Server) syncTransactions() http.HandlerFunc {
+	type itemResult struct {
+		ErrorMsg             string `json:",omitempty"`
+		ItemId               string `json:"item_id"`
+		Institution          string `json:"institution"`
+		TransactionsAdded    int    `json:"transactions_added"`
+		TransactionsModified int    `json:"transactions_modified"`
+		TransactionsRemoved  int    `json:"transactions_removed"`
+	}
+
 	type response struct {
-		ErrorMsg            string `json:",omitempty"`
-		TransactionsAdded   int    `json:"transactions_added"`
-		TransactionsRemoved int    `json:"transactions_removed"`
+		ErrorMsg             string       `json:",omitempty"`
+		Items                []itemResult `json:"items"`
+		TransactionsAdded    int          `json:"transactions_added"`
+		TransactionsModified int          `json:"transactions_modified"`
+		TransactionsRemoved  int          `json:"transactions_removed"`
 	}
 
 	return func(w http.ResponseWriter, req *http.Request) {
@@ -234,51 +665,35 @@ func (srv *Server) syncTransactions() http.HandlerFunc {
 			return
 		}
 
-		for _, item := range items {
-			cursor, err := srv.db.GetItemCursorOrNil(req.Context(), item.PlaidItemId)
-			if err != nil {
-				resp.ErrorMsg = err.Error()
-				returnJSON(w, http.StatusInternalServerError, resp)
-				return
-			}
-
-			hasMore := true
-			var added []plaid.Transaction
-			var removed []plaid.RemovedTransaction
+		// Sync every item, a failure with one item doesn't stop the others
+		resp.Items = make([]itemResult, len(items))
+		for i, item := range items {
+			ir := &resp.Items[i]
+			ir.ItemId = item.PlaidItemId
 
-			for hasMore {
-				tsr := plaid.NewTransactionsSyncRequest(item.AccessToken)
-				if cursor != "" {
-					tsr.SetCursor(cursor)
-				}
-				tsresp, _, err := srv.client.PlaidApi.TransactionsSync(req.Context()).TransactionsSyncRequest(*tsr).Execute()
-				if err != nil {
-					resp.ErrorMsg = err.Error()
-					returnJSON(w, http.StatusBadRequest, resp)
-					return
-				}
-
-				hasMore = tsresp.GetHasMore()
-
-				added = append(added, tsresp.GetAdded()...)
-				removed = append(removed, tsresp.GetRemoved()...)
-
-				cursor = tsresp.GetNextCursor()
+			institution, err := srv.db.RetrieveInstitutionById(req.Context(), item.PlaidInstitutionId)
+			if err == nil && institution != nil {
+				ir.Institution = institution.Name
 			}
 
-			// Update the cursor
-			n, err := srv.db.UpdatePlaidTransactions(req.Context(), added, removed, item.PlaidItemId, cursor)
+			res, err := srv.syncItem(req.Context(), item)
 			if err != nil {
-				resp.ErrorMsg = err.Error()
-				returnJSON(w, http.StatusInternalServerError, resp)
-				return
+				ir.ErrorMsg = err.Error()
+				continue
 			}
-			resp.TransactionsAdded = int(n)
-			resp.TransactionsRemoved = len(removed)
-			returnJSON(w, http.StatusOK, resp)
+			ir.TransactionsAdded = res.Added
+			ir.TransactionsModified = res.Modified
+			ir.TransactionsRemoved = res.Removed
+
+			resp.TransactionsAdded += res.Added
+			resp.TransactionsModified += res.Modified
+			resp.TransactionsRemoved += res.Removed
 		}
+
+		returnJSON(w, http.StatusOK, resp)
 	}
 }
+
 func (srv *Server) refreshInstitutions() http.HandlerFunc {
 	type response struct {
 		ErrorMsg string `json:",omitempty"`
@@ -362,6 +777,16 @@ func (srv *Server) refreshInstitutions() http.HandlerFunc {
 	}
 }
 
+// runInBackground runs fn in a goroutine that outlives the request that
+// started it. fn's context is cancelled when the server shuts down.
+func (srv *Server) runInBackground(fn func(ctx context.Context)) {
+	srv.bg.Add(1)
+	go func() {
+		defer srv.bg.Done()
+		fn(srv.bgCtx)
+	}()
+}
+
 func returnJSON(w http.ResponseWriter, statusCode int, data any) error {
 	js, err := json.Marshal(data)
 	if err != nil {
@@ -382,10 +807,29 @@ func returnJSON(w http.ResponseWriter, statusCode int, data any) error {
 }
 
 func (srv *Server) Start() error {
+	if srv.scheduler != nil {
+		srv.scheduler.start()
+	}
+
 	err := srv.s.ListenAndServeTLS(srv.certFile, srv.keyFile)
-	if err != nil {
+	if err != nil && err != http.ErrServerClosed {
 		return err
 	}
 
 	return nil
 }
+
+// Shutdown gracefully shuts down the HTTP server, then stops the background
+// sync scheduler and waits for background work. The server goes first so no
+// handler can start more background work while it is being drained.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	err := srv.s.Shutdown(ctx)
+
+	if srv.scheduler != nil {
+		srv.scheduler.stop()
+	}
+	srv.bgCancel()
+	srv.bg.Wait()
+
+	return err
+}
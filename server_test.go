@@ -1,7 +1,9 @@
 package expenses
 
 import (
+	"context"
 	"net/http"
+	"testing"
 
 	"github.com/plaid/plaid-go/v12/plaid"
 )
@@ -23,3 +25,41 @@ func mockPlaidClient() *plaid.APIClient {
 
 	return nil
 }
+
+func TestOverview(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+
+	if err := db.CreateNewItem(ctx, "item1", "access-token-1", "ins_1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateNewItem(ctx, "item2", "access-token-2", "ins_2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.UpdateInstitution(ctx, &Institution{PlaidInstitutionId: "ins_2", Name: "A Bank"}); err != nil {
+		t.Fatal(err)
+	}
+	accounts := []Account{{PlaidAccountId: "acct1", Name: "Checking", Type: "depository"}}
+	if err := db.CreateAccounts(ctx, accounts, "item1", "ins_1"); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{db: db}
+	overview, err := srv.overview(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(overview) != 2 {
+		t.Fatalf("got %d institutions, want 2", len(overview))
+	}
+	// Unrefreshed institutions fall back to their Plaid id for a name
+	if overview[0].Name != "A Bank" || overview[1].Name != "ins_1" {
+		t.Errorf("got institutions %q and %q", overview[0].Name, overview[1].Name)
+	}
+	if got := overview[1].Items[0].Accounts; len(got) != 1 || got[0].PlaidAccountId != "acct1" {
+		t.Errorf("got accounts %v for item1", got)
+	}
+	if got := overview[0].Items[0].Accounts; len(got) != 0 {
+		t.Errorf("got accounts %v for item2, want none", got)
+	}
+}
@@ -0,0 +1,206 @@
+package expenses
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+)
+
+var (
+	errSplitTooFew   = errors.New("a split needs at least two parts")
+	errSplitSum      = errors.New("splits must sum to the transaction amount")
+	errSplitNoAmount = errors.New("split amounts cannot be zero")
+)
+
+// Split is part of a transaction's amount allocated to a category
+type Split struct {
+	Amount     float64 `json:"amount"`
+	CategoryId *int    `json:"category_id"` // nil falls back to the transaction's category
+	Note       string  `json:"note,omitempty"`
+}
+
+// toCents converts an amount to whole cents, so sums are exact
+func toCents(amount float64) int64 {
+	return int64(math.Round(amount * 100))
+}
+
+// allocationColumnsSQL are the columns of transactionAllocationsSQL taken
+// from the transaction t
+const allocationColumnsSQL = `t.plaid_transaction_id, t.plaid_account_id, t.date,
+	COALESCE(NULLIF(r.merchant_name, ''), NULLIF(t.merchant_name, ''), t.name) AS merchant_name,
+	t.pending, ` + transactionKindSQL + ` AS kind, COALESCE(r.hidden, 0) AS hidden,
+	t.deleted_at IS NOT NULL AS deleted`
+
+// transactionAllocationsSQL is a subquery of what reports should add up: one
+// row per split of split transactions and one per other transaction. If Plaid
+// changes the amount of a split transaction, the difference is allocated to
+// the transaction's own category.
+//
+// Columns: those of allocationColumnsSQL, amount and category_id
+const transactionAllocationsSQL = `
+SELECT ` + allocationColumnsSQL + `, t.amount AS amount, ` + effectiveCategorySQL + ` AS category_id
+FROM transactions t` + effectiveCategoryJoinsSQL + `
+WHERE NOT EXISTS (SELECT 1 FROM transaction_splits s WHERE s.plaid_transaction_id=t.plaid_transaction_id)
+UNION ALL
+SELECT ` + allocationColumnsSQL + `, s.amount, COALESCE(s.category_id, ` + effectiveCategorySQL + `)
+FROM transaction_splits s
+JOIN transactions t ON t.plaid_transaction_id=s.plaid_transaction_id` + effectiveCategoryJoinsSQL + `
+UNION ALL
+SELECT ` + allocationColumnsSQL + `, t.amount-ss.total, ` + effectiveCategorySQL + `
+FROM (SELECT plaid_transaction_id, SUM(amount) AS total FROM transaction_splits GROUP BY plaid_transaction_id) ss
+JOIN transactions t ON t.plaid_transaction_id=ss.plaid_transaction_id` + effectiveCategoryJoinsSQL + `
+WHERE ROUND(t.amount*100)<>ROUND(ss.total*100)`
+
+// SetTransactionSplits replaces the splits of a transaction. The split
+// amounts must sum to the transaction's amount to the cent. No splits
+// removes them.
+func (db *DB) SetTransactionSplits(ctx context.Context, plaidTransactionId string, splits []Split) error {
+	if len(splits) == 1 {
+		return errSplitTooFew
+	}
+
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var amount float64
+	err = tx.QueryRowContext(ctx, `SELECT amount FROM transactions WHERE plaid_transaction_id=$1`, plaidTransactionId).Scan(&amount)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return errUnknownTransaction
+		}
+		return err
+	}
+
+	var total int64
+	for _, s := range splits {
+		cents := toCents(s.Amount)
+		if cents == 0 {
+			return errSplitNoAmount
+		}
+		total += cents
+		if s.CategoryId != nil {
+			var n int
+			if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM categories WHERE id=$1`, *s.CategoryId).Scan(&n); err != nil {
+				return err
+			}
+			if n == 0 {
+				return errUnknownCategory
+			}
+		}
+	}
+	if len(splits) > 0 && total != toCents(amount) {
+		return fmt.Errorf("%w: %.2f of %.2f", errSplitSum, float64(total)/100, amount)
+	}
+
+	if _, err = tx.ExecContext(ctx, `DELETE FROM transaction_splits WHERE plaid_transaction_id=$1`, plaidTransactionId); err != nil {
+		return err
+	}
+	for i, s := range splits {
+		_, err = tx.ExecContext(
+			ctx,
+			`INSERT INTO transaction_splits (plaid_transaction_id, position, amount, category_id, note)
+			 VALUES ($1, $2, $3, $4, NULLIF($5, ''))`,
+			plaidTransactionId, i, float64(toCents(s.Amount))/100, s.CategoryId, strings.TrimSpace(s.Note))
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// loadTransactionSplits sets the splits of those txns that have them
+func loadTransactionSplits(ctx context.Context, q queryer, txns []*Transaction) error {
+	if len(txns) == 0 {
+		return nil
+	}
+
+	qb := &queryBuilder{}
+	byId := make(map[string]*Transaction, len(txns))
+	placeholders := make([]string, len(txns))
+	for i, txn := range txns {
+		byId[txn.PlaidTransactionId] = txn
+		placeholders[i] = qb.arg(txn.PlaidTransactionId)
+	}
+
+	rows, err := q.QueryContext(
+		ctx,
+		`SELECT plaid_transaction_id, amount, category_id, COALESCE(note, '')
+		 FROM transaction_splits
+		 WHERE plaid_transaction_id IN (`+strings.Join(placeholders, ",")+`)
+		 ORDER BY plaid_transaction_id, position`, qb.args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		s := new(Split)
+		if err := rows.Scan(&id, &s.Amount, &s.CategoryId, &s.Note); err != nil {
+			return err
+		}
+		if txn, ok := byId[id]; ok {
+			txn.Splits = append(txn.Splits, s)
+		}
+	}
+
+	return rows.Err()
+}
+
+// statusForSplitError maps errors from splitting transactions to HTTP statuses
+func statusForSplitError(err error) int {
+	switch {
+	case errors.Is(err, errUnknownTransaction):
+		return http.StatusNotFound
+	case errors.Is(err, errUnknownCategory), errors.Is(err, errSplitTooFew),
+		errors.Is(err, errSplitSum), errors.Is(err, errSplitNoAmount):
+		return http.StatusBadRequest
+	}
+
+	return http.StatusInternalServerError
+}
+
+// setTransactionSplits replaces the splits of one transaction, an empty list
+// of splits removes them
+func (srv *Server) setTransactionSplits() http.HandlerFunc {
+	type payload struct {
+		TransactionId string  `json:"transaction_id"`
+		Splits        []Split `json:"splits"`
+	}
+
+	type response struct {
+		ErrorMsg string `json:",omitempty"`
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+
+		var resp response
+
+		pay := payload{}
+		if err := json.NewDecoder(req.Body).Decode(&pay); err != nil {
+			resp.ErrorMsg = err.Error()
+			returnJSON(w, http.StatusBadRequest, resp)
+			return
+		}
+		if err := srv.db.SetTransactionSplits(req.Context(), pay.TransactionId, pay.Splits); err != nil {
+			resp.ErrorMsg = err.Error()
+			returnJSON(w, statusForSplitError(err), resp)
+			return
+		}
+
+		returnJSON(w, http.StatusOK, resp)
+	}
+}
@@ -0,0 +1,79 @@
+package expenses
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/plaid/plaid-go/v12/plaid"
+)
+
+func TestTransactionSplits(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+
+	added := []plaid.Transaction{
+		testTransaction("t1", "a1", "2023-06-01", "Costco", 0.3),
+		testTransaction("t2", "a1", "2023-06-02", "Safeway", 20),
+	}
+	if _, err := db.UpdatePlaidTransactions(ctx, added, nil, nil, "item1", "c1"); err != nil {
+		t.Fatal(err)
+	}
+	gifts := &Category{Name: "Gifts"}
+	if err := db.SaveCategory(ctx, gifts); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.SetTransactionSplits(ctx, "t1", []Split{{Amount: 0.3}}); !errors.Is(err, errSplitTooFew) {
+		t.Errorf("got %v for a single split, want %v", err, errSplitTooFew)
+	}
+	if err := db.SetTransactionSplits(ctx, "t1", []Split{{Amount: 0.1}, {Amount: 0.1}}); !errors.Is(err, errSplitSum) {
+		t.Errorf("got %v for splits short of the amount, want %v", err, errSplitSum)
+	}
+	// 0.1 + 0.2 isn't 0.3 in floating point, but is in cents
+	splits := []Split{{Amount: 0.1}, {Amount: 0.2, CategoryId: &gifts.Id, Note: "Birthday"}}
+	if err := db.SetTransactionSplits(ctx, "t1", splits); err != nil {
+		t.Fatal(err)
+	}
+
+	txns, err := db.QueryTransactions(ctx, TransactionFilter{CategoryId: &gifts.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txns) != 1 || len(txns[0].Splits) != 2 || txns[0].Splits[1].Note != "Birthday" {
+		t.Fatalf("filtered by a split's category to %+v, want t1 with its splits", txns)
+	}
+
+	spending := func() map[string]float64 {
+		t.Helper()
+		totals, err := db.SpendingByCategory(ctx, "2023-06-01", "2023-06-30")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make(map[string]float64)
+		for _, ct := range totals {
+			got[ct.CategoryName] = ct.Amount
+		}
+		return got
+	}
+	if got := spending(); got["Gifts"] != 0.2 || got["Food & Drink"] != 20.1 {
+		t.Errorf("got spending %v, want Gifts 0.2 and Food & Drink 20.1", got)
+	}
+
+	// When Plaid changes the amount the difference keeps the transaction's
+	// category
+	modified := []plaid.Transaction{testTransaction("t1", "a1", "2023-06-01", "Costco", 1.3)}
+	if _, err := db.UpdatePlaidTransactions(ctx, nil, modified, nil, "item1", "c2"); err != nil {
+		t.Fatal(err)
+	}
+	if got := spending(); got["Gifts"] != 0.2 || got["Food & Drink"] != 21.1 {
+		t.Errorf("got spending %v, want Gifts 0.2 and Food & Drink 21.1", got)
+	}
+
+	if err := db.SetTransactionSplits(ctx, "t1", nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := spending(); got["Gifts"] != 0 || got["Food & Drink"] != 21.3 {
+		t.Errorf("got spending %v after removing splits, want all Food & Drink", got)
+	}
+}
@@ -0,0 +1,154 @@
+package expenses
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// Encrypted databases require the sqlite3 driver to be linked against
+// SQLCipher instead of the bundled SQLite, e.g.
+//
+//	CGO_CFLAGS=-I/usr/include/sqlcipher CGO_LDFLAGS=-lsqlcipher go build -tags libsqlite3 ./cmd/expenses
+var errNoSQLCipher = errors.New("SQLite is not built with SQLCipher (build with -tags libsqlite3 and link against SQLCipher)")
+
+// keyedConnector opens SQLite connections and keys each one with a SQLCipher
+// passphrase before it is used.
+type keyedConnector struct {
+	dsn    string
+	driver *sqlite3.SQLiteDriver
+}
+
+func newKeyedConnector(dsn, passphrase string) *keyedConnector {
+	pragma := "PRAGMA key = " + quoteSQLString(passphrase)
+
+	return &keyedConnector{
+		dsn: dsn,
+		driver: &sqlite3.SQLiteDriver{
+			ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+				_, err := conn.Exec(pragma, nil)
+				return err
+			},
+		},
+	}
+}
+
+func (kc *keyedConnector) Connect(context.Context) (driver.Conn, error) {
+	return kc.driver.Open(kc.dsn)
+}
+func (kc *keyedConnector) Driver() driver.Driver { return kc.driver }
+
+// openSQLite opens a SQLite database, encrypted with SQLCipher if passphrase is
+// not empty.
+func openSQLite(fname, passphrase string) (*sql.DB, error) {
+	if passphrase == "" {
+		return sql.Open("sqlite3", fname)
+	}
+
+	db := sql.OpenDB(newKeyedConnector(fname, passphrase))
+
+	// Plain SQLite silently ignores PRAGMA key, so make sure SQLCipher is
+	// actually present before trusting the database to be encrypted.
+	var version string
+	err := db.QueryRow("PRAGMA cipher_version").Scan(&version)
+	if err == sql.ErrNoRows || (err == nil && version == "") {
+		db.Close()
+		return nil, errNoSQLCipher
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// ExportEncrypted writes an encrypted copy of the database to fname using
+// SQLCipher's sqlcipher_export.
+func (db *DB) ExportEncrypted(ctx context.Context, fname, passphrase string) error {
+	if passphrase == "" {
+		return errors.New("a passphrase is required to encrypt the database")
+	}
+
+	conn, err := db.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var version string
+	if err = conn.QueryRowContext(ctx, "PRAGMA cipher_version").Scan(&version); err != nil || version == "" {
+		return errNoSQLCipher
+	}
+
+	if _, err = conn.ExecContext(ctx, `ATTACH DATABASE $1 AS encrypted KEY $2`, fname, passphrase); err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, `DETACH DATABASE encrypted`)
+
+	_, err = conn.ExecContext(ctx, `SELECT sqlcipher_export('encrypted')`)
+	return err
+}
+
+// TableRowCounts returns the number of rows in each table of the database.
+func (db *DB) TableRowCounts(ctx context.Context) (map[string]int64, error) {
+	rows, err := db.db.QueryContext(
+		ctx,
+		`SELECT name
+		 FROM sqlite_master
+		 WHERE type='table' AND name NOT LIKE 'sqlite_%'`)
+	if err != nil {
+		return nil, err
+	}
+	var tables []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		tables = append(tables, name)
+	}
+	rows.Close()
+
+	counts := make(map[string]int64, len(tables))
+	for _, table := range tables {
+		var n int64
+		err := db.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+quoteSQLIdent(table)).Scan(&n)
+		if err != nil {
+			return nil, err
+		}
+		counts[table] = n
+	}
+
+	return counts, nil
+}
+
+// CompareRowCounts reports the tables whose row counts differ between two
+// databases.
+func CompareRowCounts(want, got map[string]int64) error {
+	var mismatched []string
+	for table, n := range want {
+		if got[table] != n {
+			mismatched = append(mismatched, fmt.Sprintf("%s (%d != %d)", table, n, got[table]))
+		}
+	}
+	if len(mismatched) > 0 {
+		return fmt.Errorf("row counts differ: %s", strings.Join(mismatched, ", "))
+	}
+
+	return nil
+}
+
+func quoteSQLString(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+func quoteSQLIdent(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
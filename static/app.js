@@ -14,24 +14,182 @@ function linkSuccess(public_token, metadata) {
     });
 }
 
+function openLink(token, onSuccess) {
+    Plaid.create({
+        token: token,
+        onSuccess: onSuccess,
+        onExit: (err, metadata) => {
+            console.error(err, metadata);
+        },
+        onEvent: (eventName, metadata) => {
+            console.log("Event:", eventName);
+            console.log("Metadata:", metadata);
+        },
+    }).open()
+}
+
+// Relaunch Link in update mode so the user can re-authenticate a broken item.
+// In update mode there is no public token to exchange, the item keeps its
+// access token.
+function repairItem(itemId) {
+    fetch("/create_update_link_token", {
+        method: 'POST',
+        body: JSON.stringify({item_id: itemId}),
+        headers: {
+            "Content-Type": "application/json",
+        }
+    })
+        .then((response) => response.json())
+        .then((res) => {
+            if (res.ErrorMsg) {
+                throw new Error(res.ErrorMsg);
+            }
+            openLink(res.LinkToken, (public_token, metadata) => {
+                fetch("/item_repaired", {
+                    method: 'POST',
+                    body: JSON.stringify({item_id: itemId}),
+                    headers: {
+                        "Content-Type": "application/json",
+                    }
+                }).then(() => window.location.reload());
+            });
+        })
+        .catch(console.error)
+}
+
+function postJSON(url, body) {
+    return fetch(url, {
+        method: 'POST',
+        body: JSON.stringify(body),
+        headers: {
+            "Content-Type": "application/json",
+        }
+    });
+}
+
+// Override the category of a transaction, 0 goes back to the mapped category
+function setCategory(transactionId, categoryId) {
+    postJSON("/api/transactions/category", {transaction_id: transactionId, category_id: categoryId})
+        .then(() => window.location.reload())
+        .catch(console.error)
+}
+
+// Classify a transaction by hand, an empty kind classifies it automatically
+function setKind(transactionId, kind) {
+    postJSON("/api/transactions/kind", {transaction_id: transactionId, kind: kind})
+        .then(() => window.location.reload())
+        .catch(console.error)
+}
+
+function editTags(transactionId, current) {
+    const tags = prompt("Tags, separated by commas", current);
+    if (tags === null) {
+        return;
+    }
+    postJSON("/api/transactions/tags", {transaction_id: transactionId, tags: tags.split(",")})
+        .then(() => window.location.reload())
+        .catch(console.error)
+}
+
+function editNote(transactionId, current) {
+    const note = prompt("Note", current);
+    if (note === null) {
+        return;
+    }
+    postJSON("/api/transactions/note", {transaction_id: transactionId, note: note})
+        .then(() => window.location.reload())
+        .catch(console.error)
+}
+
+// Create a budget, or change the budget of a category that already has one
+function saveBudget(form) {
+    const budget = {
+        category_id: parseInt(form.category_id.value),
+        amount: parseFloat(form.amount.value),
+        rollover: form.rollover.checked,
+        start_month: form.start_month.value,
+    };
+    fetch("/api/budgets?category_id=" + budget.category_id)
+        .then((response) => response.json())
+        .then((res) => {
+            if (res.ErrorMsg) {
+                throw new Error(res.ErrorMsg);
+            }
+            if (res.budget) {
+                budget.id = res.budget.id;
+            }
+            return postJSON("/api/budgets", budget);
+        })
+        .then(() => window.location.reload())
+        .catch(console.error)
+}
+
+function deleteBudget(budgetId) {
+    postJSON("/api/budgets/delete", {id: budgetId})
+        .then(() => window.location.reload())
+        .catch(console.error)
+}
+
+// Match or reject a pair of transactions as the two legs of a transfer
+function reviewTransfer(pairId, match) {
+    postJSON("/api/transfers/review", {id: pairId, match: match})
+        .then(() => window.location.reload())
+        .catch(console.error)
+}
+
 window.addEventListener("load", (event) => {
     const el = document.querySelector("#start");
-    el.addEventListener("click", (event) => {
-        fetch("/create_link_token", {method: 'POST'})
-            .then((response) => response.json())
-            .then((res) => {
-                Plaid.create({
-                    token: res.LinkToken,
-                    onSuccess: linkSuccess,
-                    onExit: (err, metadata) => {
-                        console.error(err, metadata);
-                    },
-                    onEvent: (eventName, metadata) => {
-                        console.log("Event:", eventName);
-                        console.log("Metadata:", metadata);
-                    },
-                }).open()
-            })
-            .catch(console.error)
+    if (el) {
+        el.addEventListener("click", (event) => {
+            fetch("/create_link_token", {method: 'POST'})
+                .then((response) => response.json())
+                .then((res) => openLink(res.LinkToken, linkSuccess))
+                .catch(console.error)
+        });
+    }
+
+    document.querySelectorAll(".repair").forEach((el) => {
+        el.addEventListener("click", (event) => repairItem(el.dataset.itemId));
+    });
+
+    document.querySelectorAll(".set-category").forEach((el) => {
+        el.addEventListener("change", (event) => setCategory(el.dataset.transactionId, parseInt(el.value)));
+    });
+
+    document.querySelectorAll(".set-kind").forEach((el) => {
+        el.addEventListener("change", (event) => setKind(el.dataset.transactionId, el.value));
+    });
+
+    document.querySelectorAll(".edit-tags").forEach((el) => {
+        el.addEventListener("click", (event) => editTags(el.dataset.transactionId, el.dataset.tags));
+    });
+
+    document.querySelectorAll(".edit-note").forEach((el) => {
+        el.addEventListener("click", (event) => editNote(el.dataset.transactionId, el.dataset.note));
+    });
+
+    const budget = document.querySelector("#budget");
+    if (budget) {
+        budget.addEventListener("submit", (event) => {
+            event.preventDefault();
+            saveBudget(budget);
+        });
+    }
+
+    document.querySelectorAll(".delete-budget").forEach((el) => {
+        el.addEventListener("click", (event) => deleteBudget(parseInt(el.dataset.budgetId)));
+    });
+
+    const match = document.querySelector("#match-transfers");
+    if (match) {
+        match.addEventListener("click", (event) => {
+            fetch("/api/transfers/match", {method: 'POST'})
+                .then(() => window.location.reload())
+                .catch(console.error)
+        });
+    }
+
+    document.querySelectorAll(".review-transfer").forEach((el) => {
+        el.addEventListener("click", (event) => reviewTransfer(parseInt(el.dataset.pairId), el.dataset.match === "true"));
     });
 });
@@ -0,0 +1,156 @@
+package expenses
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/plaid/plaid-go/v12/plaid"
+)
+
+var errSyncInProgress = errors.New("sync already in progress for item")
+
+// SyncResult summarizes one sync of an item's transactions.
+type SyncResult struct {
+	Added    int
+	Modified int
+	Removed  int
+}
+
+// itemLocks ensures only one sync runs for an item at a time, regardless of
+// whether it was triggered by the scheduler or over HTTP.
+type itemLocks struct {
+	mu     sync.Mutex
+	active map[string]bool
+}
+
+// tryLock returns false if the item is already locked.
+func (il *itemLocks) tryLock(itemId string) bool {
+	il.mu.Lock()
+	defer il.mu.Unlock()
+
+	if il.active == nil {
+		il.active = make(map[string]bool)
+	}
+	if il.active[itemId] {
+		return false
+	}
+	il.active[itemId] = true
+
+	return true
+}
+
+func (il *itemLocks) unlock(itemId string) {
+	il.mu.Lock()
+	defer il.mu.Unlock()
+
+	delete(il.active, itemId)
+}
+
+// syncItem pulls all transaction updates for item since its last cursor and
+// stores them. The outcome is recorded against the item to track its health.
+func (srv *Server) syncItem(ctx context.Context, item *Item) (*SyncResult, error) {
+	if !srv.syncing.tryLock(item.PlaidItemId) {
+		return nil, errSyncInProgress
+	}
+	defer srv.syncing.unlock(item.PlaidItemId)
+
+	res, err := srv.syncItemTransactions(ctx, item)
+	if ctx.Err() != nil {
+		// Cancelled, e.g. the server is shutting down. Not the item's fault.
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		code, msg := describeError(err)
+		if rerr := srv.db.RecordItemSyncFailure(ctx, item.PlaidItemId, code, msg); rerr != nil {
+			log.Printf("Failed to record sync failure of item %s: %v", item.PlaidItemId, rerr)
+		}
+		return nil, err
+	}
+
+	if err = srv.db.RecordItemSyncSuccess(ctx, item.PlaidItemId); err != nil {
+		return nil, err
+	}
+
+	// Balances are a nice to have, don't fail the sync over them
+	if err = srv.refreshBalances(ctx, item); err != nil {
+		log.Printf("Failed to refresh balances of item %s: %v", item.PlaidItemId, err)
+	}
+
+	// Nor over transfers, the other leg may be in another item
+	if _, err = srv.db.MatchTransfers(ctx); err != nil {
+		log.Printf("Failed to match transfers after syncing item %s: %v", item.PlaidItemId, err)
+	}
+
+	return res, nil
+}
+
+func (srv *Server) syncItemTransactions(ctx context.Context, item *Item) (*SyncResult, error) {
+	cursor, err := srv.db.GetItemCursorOrNil(ctx, item.PlaidItemId)
+	if err != nil {
+		return nil, err
+	}
+
+	hasMore := true
+	var added, modified []plaid.Transaction
+	var removed []plaid.RemovedTransaction
+
+	for hasMore {
+		tsr := plaid.NewTransactionsSyncRequest(item.AccessToken)
+		if cursor != "" {
+			tsr.SetCursor(cursor)
+		}
+		tsro := plaid.NewTransactionsSyncRequestOptions()
+		tsro.SetIncludePersonalFinanceCategory(true)
+		tsr.SetOptions(*tsro)
+		tsresp, _, err := srv.client.PlaidApi.TransactionsSync(ctx).TransactionsSyncRequest(*tsr).Execute()
+		if err != nil {
+			return nil, err
+		}
+
+		hasMore = tsresp.GetHasMore()
+
+		added = append(added, tsresp.GetAdded()...)
+		modified = append(modified, tsresp.GetModified()...)
+		removed = append(removed, tsresp.GetRemoved()...)
+
+		cursor = tsresp.GetNextCursor()
+	}
+
+	// Update the cursor
+	n, err := srv.db.UpdatePlaidTransactions(ctx, added, modified, removed, item.PlaidItemId, cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SyncResult{Added: int(n), Modified: len(modified), Removed: len(removed)}, nil
+}
+
+// describeError returns the Plaid error code and message for errors from the
+// Plaid API, and just the message for anything else.
+func describeError(err error) (code, msg string) {
+	if perr, cerr := plaid.ToPlaidError(err); cerr == nil {
+		return perr.ErrorCode, perr.ErrorMessage
+	}
+
+	return "", err.Error()
+}
+
+// statusForError maps errors from the Plaid API to 400 and everything else to
+// 500.
+func statusForError(err error) int {
+	var perr plaid.GenericOpenAPIError
+	if errors.As(err, &perr) {
+		return http.StatusBadRequest
+	}
+	if errors.Is(err, errSyncInProgress) {
+		return http.StatusConflict
+	}
+	if errors.Is(err, errUnknownItem) {
+		return http.StatusNotFound
+	}
+
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,298 @@
+package expenses
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// Tag is a label that can be attached to any number of transactions
+type Tag struct {
+	Id           int    `json:"id"`
+	Name         string `json:"name"`
+	Transactions int    `json:"transactions"` // number of transactions tagged
+}
+
+func (db *DB) RetrieveTags(ctx context.Context) ([]*Tag, error) {
+	rows, err := db.db.QueryContext(
+		ctx,
+		`SELECT tg.id, tg.name, COUNT(tt.tag_id)
+		 FROM tags tg
+		 LEFT JOIN transaction_tags tt ON tt.tag_id=tg.id
+		 GROUP BY tg.id
+		 ORDER BY tg.name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tags []*Tag
+	for rows.Next() {
+		tag := new(Tag)
+		if err := rows.Scan(&tag.Id, &tag.Name, &tag.Transactions); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+
+	return tags, rows.Err()
+}
+
+// transactionExists returns errUnknownTransaction if there is no transaction
+// with the Plaid id
+func transactionExists(ctx context.Context, q queryer, plaidTransactionId string) error {
+	var n int
+	err := q.QueryRowContext(ctx, `SELECT COUNT(*) FROM transactions WHERE plaid_transaction_id=$1`, plaidTransactionId).Scan(&n)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errUnknownTransaction
+	}
+
+	return nil
+}
+
+// SetTransactionTags replaces the tags of a transaction. Tags that rules add
+// and that are kept stay owned by the rules, a rule tag that is removed comes
+// back the next time rules are applied.
+func (db *DB) SetTransactionTags(ctx context.Context, plaidTransactionId string, tags []string) error {
+	tags = normalizeTags(tags)
+
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = transactionExists(ctx, tx, plaidTransactionId); err != nil {
+		return err
+	}
+
+	qb := &queryBuilder{}
+	qb.where("plaid_transaction_id=" + qb.arg(plaidTransactionId))
+	placeholders := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		id, err := tagId(ctx, tx, tag)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(
+			ctx,
+			`INSERT INTO transaction_tags (plaid_transaction_id, tag_id)
+			 VALUES ($1, $2)
+			 ON CONFLICT (plaid_transaction_id, tag_id) DO NOTHING`, plaidTransactionId, id)
+		if err != nil {
+			return err
+		}
+		placeholders = append(placeholders, qb.arg(id))
+	}
+	if len(placeholders) > 0 {
+		qb.where("tag_id NOT IN (" + strings.Join(placeholders, ",") + ")")
+	}
+
+	if _, err = tx.ExecContext(ctx, `DELETE FROM transaction_tags`+qb.whereClause(), qb.args...); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// SetTransactionNote sets the note on a transaction, an empty note removes it
+func (db *DB) SetTransactionNote(ctx context.Context, plaidTransactionId, note string) error {
+	note = strings.TrimSpace(note)
+	if note == "" {
+		_, err := db.db.ExecContext(ctx, `DELETE FROM transaction_notes WHERE plaid_transaction_id=$1`, plaidTransactionId)
+		return err
+	}
+	if err := transactionExists(ctx, db.db, plaidTransactionId); err != nil {
+		return err
+	}
+
+	_, err := db.db.ExecContext(
+		ctx,
+		`INSERT INTO transaction_notes (plaid_transaction_id, note)
+		 VALUES ($1, $2)
+		 ON CONFLICT (plaid_transaction_id) DO UPDATE SET note=excluded.note, updated_at=CURRENT_TIMESTAMP`,
+		plaidTransactionId, note)
+	return err
+}
+
+// carryOverAnnotations copies what was added by hand to a pending transaction
+// to the posted transaction that replaces it. Plaid gives posted transactions
+// a new id.
+func carryOverAnnotations(ctx context.Context, ex execer, pendingId, postedId string) error {
+	// Parameters are numbered by first use, so the posted id is $1
+	for _, query := range []string{
+		`INSERT INTO transaction_notes (plaid_transaction_id, note, updated_at)
+		 SELECT $1, note, updated_at FROM transaction_notes WHERE plaid_transaction_id=$2
+		 ON CONFLICT (plaid_transaction_id) DO NOTHING`,
+		`INSERT INTO transaction_tags (plaid_transaction_id, tag_id)
+		 SELECT $1, tag_id FROM transaction_tags WHERE plaid_transaction_id=$2 AND NOT added_by_rule
+		 ON CONFLICT (plaid_transaction_id, tag_id) DO NOTHING`,
+		`INSERT INTO transaction_overrides (plaid_transaction_id, category_id, kind, updated_at)
+		 SELECT $1, category_id, kind, updated_at FROM transaction_overrides WHERE plaid_transaction_id=$2
+		 ON CONFLICT (plaid_transaction_id) DO NOTHING`,
+		`INSERT INTO transaction_splits (plaid_transaction_id, position, amount, category_id, note)
+		 SELECT $1, position, amount, category_id, note FROM transaction_splits WHERE plaid_transaction_id=$2
+		 AND NOT EXISTS (SELECT 1 FROM transaction_splits WHERE plaid_transaction_id=$1)`,
+	} {
+		if _, err := ex.ExecContext(ctx, query, postedId, pendingId); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// loadTransactionTags sets the tags of txns
+func loadTransactionTags(ctx context.Context, q queryer, txns []*Transaction) error {
+	if len(txns) == 0 {
+		return nil
+	}
+
+	qb := &queryBuilder{}
+	byId := make(map[string]*Transaction, len(txns))
+	placeholders := make([]string, len(txns))
+	for i, txn := range txns {
+		txn.Tags = []string{}
+		byId[txn.PlaidTransactionId] = txn
+		placeholders[i] = qb.arg(txn.PlaidTransactionId)
+	}
+
+	rows, err := q.QueryContext(
+		ctx,
+		`SELECT tt.plaid_transaction_id, tg.name
+		 FROM transaction_tags tt
+		 JOIN tags tg ON tg.id=tt.tag_id
+		 WHERE tt.plaid_transaction_id IN (`+strings.Join(placeholders, ",")+`)
+		 ORDER BY tg.name`, qb.args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, tag string
+		if err := rows.Scan(&id, &tag); err != nil {
+			return err
+		}
+		if txn, ok := byId[id]; ok {
+			txn.Tags = append(txn.Tags, tag)
+		}
+	}
+
+	return rows.Err()
+}
+
+// statusForAnnotationError maps errors from editing tags and notes to HTTP
+// statuses
+func statusForAnnotationError(err error) int {
+	if errors.Is(err, errUnknownTransaction) {
+		return http.StatusNotFound
+	}
+
+	return http.StatusInternalServerError
+}
+
+// listTags lists every tag with how many transactions have it
+func (srv *Server) listTags() http.HandlerFunc {
+	type response struct {
+		ErrorMsg string `json:",omitempty"`
+		Tags     []*Tag `json:"tags"`
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+
+		var resp response
+
+		tags, err := srv.db.RetrieveTags(req.Context())
+		if err != nil {
+			resp.ErrorMsg = err.Error()
+			returnJSON(w, http.StatusInternalServerError, resp)
+			return
+		}
+		resp.Tags = tags
+		if resp.Tags == nil {
+			resp.Tags = []*Tag{}
+		}
+
+		returnJSON(w, http.StatusOK, resp)
+	}
+}
+
+// setTransactionTags replaces the tags of one transaction
+func (srv *Server) setTransactionTags() http.HandlerFunc {
+	type payload struct {
+		TransactionId string   `json:"transaction_id"`
+		Tags          []string `json:"tags"`
+	}
+
+	type response struct {
+		ErrorMsg string `json:",omitempty"`
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+
+		var resp response
+
+		pay := payload{}
+		if err := json.NewDecoder(req.Body).Decode(&pay); err != nil {
+			resp.ErrorMsg = err.Error()
+			returnJSON(w, http.StatusBadRequest, resp)
+			return
+		}
+		if err := srv.db.SetTransactionTags(req.Context(), pay.TransactionId, pay.Tags); err != nil {
+			resp.ErrorMsg = err.Error()
+			returnJSON(w, statusForAnnotationError(err), resp)
+			return
+		}
+
+		returnJSON(w, http.StatusOK, resp)
+	}
+}
+
+// setTransactionNote sets or, when empty, removes the note on one transaction
+func (srv *Server) setTransactionNote() http.HandlerFunc {
+	type payload struct {
+		TransactionId string `json:"transaction_id"`
+		Note          string `json:"note"`
+	}
+
+	type response struct {
+		ErrorMsg string `json:",omitempty"`
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+
+		var resp response
+
+		pay := payload{}
+		if err := json.NewDecoder(req.Body).Decode(&pay); err != nil {
+			resp.ErrorMsg = err.Error()
+			returnJSON(w, http.StatusBadRequest, resp)
+			return
+		}
+		if err := srv.db.SetTransactionNote(req.Context(), pay.TransactionId, pay.Note); err != nil {
+			resp.ErrorMsg = err.Error()
+			returnJSON(w, statusForAnnotationError(err), resp)
+			return
+		}
+
+		returnJSON(w, http.StatusOK, resp)
+	}
+}
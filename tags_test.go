@@ -0,0 +1,99 @@
+package expenses
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"testing"
+
+	"github.com/plaid/plaid-go/v12/plaid"
+)
+
+func TestTransactionTagsAndNotes(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+
+	added := []plaid.Transaction{
+		testTransaction("t1", "a1", "2023-06-01", "Hardware Store", 80),
+		testTransaction("t2", "a1", "2023-06-02", "Safeway", 30),
+	}
+	if _, err := db.UpdatePlaidTransactions(ctx, added, nil, nil, "item1", "c1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.SetTransactionTags(ctx, "t1", []string{"house", " reimbursable ", "house", ""}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetTransactionTags(ctx, "t2", []string{"reimbursable"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetTransactionNote(ctx, "t1", "Deck repairs"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetTransactionNote(ctx, "missing", "?"); !errors.Is(err, errUnknownTransaction) {
+		t.Errorf("got %v noting a missing transaction, want %v", err, errUnknownTransaction)
+	}
+
+	txns, err := db.QueryTransactions(ctx, TransactionFilter{Tags: []string{"house"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txns) != 1 || txns[0].PlaidTransactionId != "t1" {
+		t.Fatalf("filtered by tag to %+v, want only t1", txns)
+	}
+	if got := txns[0].Tags; len(got) != 2 || got[0] != "house" || got[1] != "reimbursable" {
+		t.Errorf("got tags %v, want [house reimbursable]", got)
+	}
+	if txns[0].Note != "Deck repairs" {
+		t.Errorf("got note %q, want Deck repairs", txns[0].Note)
+	}
+
+	// The page submits an empty tag when not filtering by one
+	f, err := ParseTransactionFilter(url.Values{"tag": {""}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if txns, err = db.QueryTransactions(ctx, f); err != nil {
+		t.Fatal(err)
+	}
+	if len(txns) != 2 {
+		t.Errorf("got %d transactions for an empty tag, want all 2", len(txns))
+	}
+
+	// Replacing the tags drops the ones left out
+	if err := db.SetTransactionTags(ctx, "t1", []string{"house"}); err != nil {
+		t.Fatal(err)
+	}
+	txns, err = db.QueryTransactions(ctx, TransactionFilter{Tags: []string{"reimbursable"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txns) != 1 || txns[0].PlaidTransactionId != "t2" {
+		t.Errorf("filtered by tag to %+v, want only t2", txns)
+	}
+
+	// Annotations survive Plaid modifying the transaction, and follow a
+	// pending transaction to the posted one that replaces it
+	modified := []plaid.Transaction{testTransaction("t1", "a1", "2023-06-01", "Hardware Store", 85)}
+	posted := testTransaction("t3", "a1", "2023-06-03", "Safeway", 31)
+	posted.SetPendingTransactionId("t2")
+	removed := []plaid.RemovedTransaction{{TransactionId: plaid.PtrString("t2")}}
+	if _, err := db.UpdatePlaidTransactions(ctx, []plaid.Transaction{posted}, modified, removed, "item1", "c2"); err != nil {
+		t.Fatal(err)
+	}
+
+	txns, err = db.QueryTransactions(ctx, TransactionFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]*Transaction)
+	for _, txn := range txns {
+		got[txn.PlaidTransactionId] = txn
+	}
+	if got["t1"] == nil || got["t1"].Note != "Deck repairs" || len(got["t1"].Tags) != 1 {
+		t.Errorf("got %+v after modification, want note and tag kept", got["t1"])
+	}
+	if got["t3"] == nil || len(got["t3"].Tags) != 1 || got["t3"].Tags[0] != "reimbursable" {
+		t.Errorf("got %+v for posted transaction, want the pending transaction's tag", got["t3"])
+	}
+}
@@ -0,0 +1,630 @@
+package expenses
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// normalizeTransactionsSQL derives rows of the transactions table from the raw
+// Plaid JSON in plaid_transactions. It must be followed by a WHERE clause
+// selecting the plaid_transactions rows to (re)derive.
+const normalizeTransactionsSQL = `
+INSERT INTO transactions
+	(plaid_transaction_id, plaid_item_id, plaid_account_id, date, authorized_date, amount,
+	 iso_currency_code, merchant_name, name, pending, category, category_detailed,
+	 payment_channel, deleted_at)
+SELECT plaid_transaction_id,
+	plaid_item_id,
+	json_extract(plaid_transaction, '$.account_id'),
+	json_extract(plaid_transaction, '$.date'),
+	json_extract(plaid_transaction, '$.authorized_date'),
+	json_extract(plaid_transaction, '$.amount'),
+	COALESCE(json_extract(plaid_transaction, '$.iso_currency_code'),
+		json_extract(plaid_transaction, '$.unofficial_currency_code')),
+	json_extract(plaid_transaction, '$.merchant_name'),
+	json_extract(plaid_transaction, '$.name'),
+	json_extract(plaid_transaction, '$.pending'),
+	json_extract(plaid_transaction, '$.personal_finance_category.primary'),
+	json_extract(plaid_transaction, '$.personal_finance_category.detailed'),
+	json_extract(plaid_transaction, '$.payment_channel'),
+	deleted_at
+FROM plaid_transactions
+`
+
+// The ON CONFLICT clause comes after the WHERE clause.
+const normalizeTransactionsUpsertSQL = `
+ON CONFLICT (plaid_transaction_id) DO UPDATE SET
+	plaid_item_id=excluded.plaid_item_id,
+	plaid_account_id=excluded.plaid_account_id,
+	date=excluded.date,
+	authorized_date=excluded.authorized_date,
+	amount=excluded.amount,
+	iso_currency_code=excluded.iso_currency_code,
+	merchant_name=excluded.merchant_name,
+	name=excluded.name,
+	pending=excluded.pending,
+	category=excluded.category,
+	category_detailed=excluded.category_detailed,
+	payment_channel=excluded.payment_channel,
+	deleted_at=excluded.deleted_at`
+
+// normalizeTransaction refreshes the transactions row for a single Plaid
+// transaction from its raw JSON.
+func normalizeTransaction(ctx context.Context, txn execer, plaidTransactionId string) error {
+	_, err := txn.ExecContext(
+		ctx,
+		normalizeTransactionsSQL+`WHERE plaid_transaction_id=$1`+normalizeTransactionsUpsertSQL,
+		plaidTransactionId)
+
+	return err
+}
+
+// RebuildTransactions recreates the transactions table from plaid_transactions
+// and returns the number of rows written.
+func (db *DB) RebuildTransactions(ctx context.Context) (int64, error) {
+	txn, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer txn.Rollback()
+
+	if _, err = txn.ExecContext(ctx, `DELETE FROM transactions`); err != nil {
+		return 0, err
+	}
+	res, err := txn.ExecContext(ctx, normalizeTransactionsSQL+`WHERE true`+normalizeTransactionsUpsertSQL)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	if err = txn.Commit(); err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// Transaction is a normalized transaction as returned by the API
+type Transaction struct {
+	Id                 int      `json:"-"`
+	PlaidTransactionId string   `json:"id"`
+	PlaidItemId        string   `json:"item_id"`
+	PlaidAccountId     string   `json:"account_id"`
+	AccountName        string   `json:"account_name"`
+	AccountMask        string   `json:"account_mask"`
+	InstitutionId      string   `json:"institution_id"`
+	Date               string   `json:"date"`
+	AuthorizedDate     string   `json:"authorized_date,omitempty"`
+	Amount             float64  `json:"amount"`
+	IsoCurrencyCode    string   `json:"currency"`
+	MerchantName       string   `json:"merchant"`
+	Name               string   `json:"name"`
+	Pending            bool     `json:"pending"`
+	Category           string   `json:"category"`
+	CategoryDetailed   string   `json:"category_detailed"`
+	CategoryId         *int     `json:"category_id"` // our category, see effectiveCategorySQL
+	CategoryName       string   `json:"category_name,omitempty"`
+	CategoryColor      string   `json:"category_color,omitempty"`
+	CategoryOverridden bool     `json:"category_overridden"`
+	Transfer           bool     `json:"transfer"` // marked a transfer by a rule
+	Kind               string   `json:"kind"`     // see transactionKindSQL
+	KindOverridden     bool     `json:"kind_overridden"`
+	Hidden             bool     `json:"hidden"`
+	PaymentChannel     string   `json:"payment_channel"`
+	Deleted            bool     `json:"deleted"`
+	Tags               []string `json:"tags"`
+	Note               string   `json:"note,omitempty"`
+	Splits             []*Split `json:"splits,omitempty"`
+}
+
+// TransactionCursor is the position of the last transaction of a page.
+// Transactions are ordered newest first.
+type TransactionCursor struct {
+	Date string
+	Id   int
+}
+
+func (c TransactionCursor) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(c.Date + "|" + strconv.Itoa(c.Id)))
+}
+
+func ParseTransactionCursor(s string) (*TransactionCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errBadCursor
+	}
+	date, idStr, ok := strings.Cut(string(raw), "|")
+	if !ok {
+		return nil, errBadCursor
+	}
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return nil, errBadCursor
+	}
+
+	return &TransactionCursor{Date: date, Id: id}, nil
+}
+
+var (
+	errBadCursor          = errors.New("invalid cursor")
+	errUnknownTransaction = errors.New("unknown transaction")
+)
+
+// TransactionFilter selects transactions. Zero values don't filter.
+type TransactionFilter struct {
+	Start, End     string // inclusive, YYYY-MM-DD
+	AccountIds     []string
+	InstitutionId  string
+	MinAmount      *float64
+	MaxAmount      *float64
+	Category       string // matches either the primary or detailed Plaid category
+	CategoryId     *int   // our category or any of its subcategories, of the transaction or a split
+	Pending        *bool
+	Kind           string   // income, expense or transfer
+	Search         string   // substring of the name, merchant or note
+	Tags           []string // has any of the tags
+	IncludeDeleted bool
+	IncludeHidden  bool // transactions hidden by rules
+
+	// Sort is one of the keys of transactionSorts, the default is by date.
+	// Cursors only work with the default sort, newest first.
+	Sort      string
+	Ascending bool
+
+	After *TransactionCursor
+	Limit int
+}
+
+// Columns transactions can be sorted by
+var transactionSorts = map[string]string{
+	"date":     "t.date",
+	"amount":   "t.amount",
+	"merchant": "COALESCE(NULLIF(r.merchant_name, ''), NULLIF(t.merchant_name, ''), t.name)",
+	"account":  "a.name",
+	"category": "COALESCE(c.name, t.category)",
+}
+
+// queryBuilder accumulates WHERE conditions and their numbered parameters
+type queryBuilder struct {
+	conds []string
+	args  []any
+}
+
+// arg adds a parameter and returns its placeholder
+func (qb *queryBuilder) arg(v any) string {
+	qb.args = append(qb.args, v)
+	return "$" + strconv.Itoa(len(qb.args))
+}
+
+func (qb *queryBuilder) where(cond string) {
+	qb.conds = append(qb.conds, cond)
+}
+
+func (qb *queryBuilder) whereClause() string {
+	if len(qb.conds) == 0 {
+		return ""
+	}
+
+	return " WHERE " + strings.Join(qb.conds, " AND ")
+}
+
+func (f *TransactionFilter) build(qb *queryBuilder) {
+	if !f.IncludeDeleted {
+		qb.where("t.deleted_at IS NULL")
+	}
+	if !f.IncludeHidden {
+		qb.where("NOT COALESCE(r.hidden, 0)")
+	}
+	if f.Start != "" {
+		qb.where("t.date>=" + qb.arg(f.Start))
+	}
+	if f.End != "" {
+		qb.where("t.date<=" + qb.arg(f.End))
+	}
+	if len(f.AccountIds) > 0 {
+		placeholders := make([]string, len(f.AccountIds))
+		for i, id := range f.AccountIds {
+			placeholders[i] = qb.arg(id)
+		}
+		qb.where("t.plaid_account_id IN (" + strings.Join(placeholders, ",") + ")")
+	}
+	if f.InstitutionId != "" {
+		qb.where("a.plaid_institution_id=" + qb.arg(f.InstitutionId))
+	}
+	if f.MinAmount != nil {
+		qb.where("t.amount>=" + qb.arg(*f.MinAmount))
+	}
+	if f.MaxAmount != nil {
+		qb.where("t.amount<=" + qb.arg(*f.MaxAmount))
+	}
+	if f.Category != "" {
+		p := qb.arg(f.Category)
+		qb.where("(t.category=" + p + " OR t.category_detailed=" + p + ")")
+	}
+	if f.CategoryId != nil {
+		tree := fmt.Sprintf(categoryTreeSQL, qb.arg(*f.CategoryId))
+		qb.where("(c.id IN (" + tree + ") OR t.plaid_transaction_id IN (" +
+			"SELECT plaid_transaction_id FROM transaction_splits WHERE category_id IN (" + tree + ")))")
+	}
+	if f.Pending != nil {
+		qb.where("t.pending=" + qb.arg(*f.Pending))
+	}
+	if f.Kind != "" {
+		qb.where(transactionKindSQL + "=" + qb.arg(f.Kind))
+	}
+	if f.Search != "" {
+		p := qb.arg("%" + f.Search + "%")
+		qb.where("(t.name LIKE " + p + " OR t.merchant_name LIKE " + p + " OR r.merchant_name LIKE " + p +
+			" OR n.note LIKE " + p + ")")
+	}
+	if len(f.Tags) > 0 {
+		placeholders := make([]string, len(f.Tags))
+		for i, tag := range f.Tags {
+			placeholders[i] = qb.arg(tag)
+		}
+		qb.where(`t.plaid_transaction_id IN (
+			SELECT tt.plaid_transaction_id FROM transaction_tags tt JOIN tags tg ON tg.id=tt.tag_id
+			WHERE tg.name IN (` + strings.Join(placeholders, ",") + "))")
+	}
+}
+
+// transactionsSelect reads the columns scanned by scanTransactions
+const transactionsSelect = `
+SELECT t.id,
+	t.plaid_transaction_id,
+	COALESCE(t.plaid_item_id, ''),
+	t.plaid_account_id,
+	COALESCE(a.name, ''),
+	COALESCE(a.account_mask, ''),
+	COALESCE(a.plaid_institution_id, ''),
+	t.date,
+	COALESCE(t.authorized_date, ''),
+	t.amount,
+	COALESCE(t.iso_currency_code, ''),
+	COALESCE(r.merchant_name, t.merchant_name, ''),
+	t.name,
+	t.pending,
+	COALESCE(t.category, ''),
+	COALESCE(t.category_detailed, ''),
+	COALESCE(t.payment_channel, ''),
+	t.deleted_at IS NOT NULL,
+	c.id,
+	COALESCE(c.name, ''),
+	COALESCE(c.color, ''),
+	o.category_id IS NOT NULL,
+	COALESCE(r.transfer, 0),
+	` + transactionKindSQL + `,
+	o.kind IS NOT NULL,
+	COALESCE(r.hidden, 0),
+	COALESCE(n.note, '')
+FROM transactions t
+LEFT JOIN accounts a ON a.plaid_account_id=t.plaid_account_id
+LEFT JOIN transaction_notes n ON n.plaid_transaction_id=t.plaid_transaction_id` + categoryJoinsSQL
+
+// QueryTransactions returns a page of transactions matching f, newest first.
+func (db *DB) QueryTransactions(ctx context.Context, f TransactionFilter) ([]*Transaction, error) {
+	sortCol := "t.date"
+	if f.Sort != "" {
+		var ok bool
+		if sortCol, ok = transactionSorts[f.Sort]; !ok {
+			return nil, fmt.Errorf("cannot sort by %q", f.Sort)
+		}
+	}
+	dir := " DESC"
+	if f.Ascending {
+		dir = " ASC"
+	}
+
+	qb := &queryBuilder{}
+	f.build(qb)
+	if f.After != nil {
+		if sortCol != "t.date" || f.Ascending {
+			return nil, errors.New("cursors require sorting by date, newest first")
+		}
+		d := qb.arg(f.After.Date)
+		qb.where("(t.date<" + d + " OR (t.date=" + d + " AND t.id<" + qb.arg(f.After.Id) + "))")
+	}
+
+	query := transactionsSelect + qb.whereClause() + " ORDER BY " + sortCol + dir + ", t.id" + dir
+	if f.Limit > 0 {
+		query += " LIMIT " + qb.arg(f.Limit)
+	}
+
+	rows, err := db.db.QueryContext(ctx, query, qb.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	txns, err := scanTransactions(rows)
+	if err != nil {
+		return nil, err
+	}
+	if err = loadTransactionTags(ctx, db.db, txns); err != nil {
+		return nil, err
+	}
+	if err = loadTransactionSplits(ctx, db.db, txns); err != nil {
+		return nil, err
+	}
+
+	return txns, nil
+}
+
+func scanTransactions(rows *sql.Rows) ([]*Transaction, error) {
+	var txns []*Transaction
+	for rows.Next() {
+		t := new(Transaction)
+		err := rows.Scan(
+			&t.Id, &t.PlaidTransactionId, &t.PlaidItemId, &t.PlaidAccountId, &t.AccountName, &t.AccountMask,
+			&t.InstitutionId, &t.Date, &t.AuthorizedDate, &t.Amount, &t.IsoCurrencyCode, &t.MerchantName,
+			&t.Name, &t.Pending, &t.Category, &t.CategoryDetailed, &t.PaymentChannel, &t.Deleted,
+			&t.CategoryId, &t.CategoryName, &t.CategoryColor, &t.CategoryOverridden,
+			&t.Transfer, &t.Kind, &t.KindOverridden, &t.Hidden, &t.Note)
+		if err != nil {
+			return nil, err
+		}
+		txns = append(txns, t)
+	}
+
+	return txns, rows.Err()
+}
+
+const (
+	defaultTransactionsLimit = 50
+	maxTransactionsLimit     = 500
+)
+
+// ParseTransactionFilter reads a TransactionFilter from URL query parameters.
+func ParseTransactionFilter(q url.Values) (TransactionFilter, error) {
+	f := TransactionFilter{
+		Start:         q.Get("start"),
+		End:           q.Get("end"),
+		InstitutionId: q.Get("institution"),
+		Tags:          normalizeTags(q["tag"]), // the page always submits a tag, often empty
+		Category:      q.Get("category"),
+		Kind:          q.Get("kind"),
+		Search:        q.Get("q"),
+		Sort:          q.Get("sort"),
+		Ascending:     q.Get("dir") == "asc",
+		Limit:         defaultTransactionsLimit,
+	}
+	// The page's "All accounts" option submits an empty account
+	for _, id := range q["account"] {
+		if id != "" {
+			f.AccountIds = append(f.AccountIds, id)
+		}
+	}
+	if _, ok := transactionSorts[f.Sort]; f.Sort != "" && !ok {
+		return f, fmt.Errorf("bad sort %q", f.Sort)
+	}
+	if f.Kind != "" && !validKind(f.Kind) {
+		return f, fmt.Errorf("bad kind %q", f.Kind)
+	}
+
+	for _, date := range []string{f.Start, f.End} {
+		if date == "" {
+			continue
+		}
+		if _, err := time.Parse(time.DateOnly, date); err != nil {
+			return f, fmt.Errorf("bad date %q, expected YYYY-MM-DD", date)
+		}
+	}
+
+	var err error
+	parseAmount := func(name string) *float64 {
+		s := q.Get(name)
+		if s == "" || err != nil {
+			return nil
+		}
+		v, perr := strconv.ParseFloat(s, 64)
+		if perr != nil {
+			err = fmt.Errorf("bad %s %q", name, s)
+			return nil
+		}
+		return &v
+	}
+	f.MinAmount = parseAmount("min_amount")
+	f.MaxAmount = parseAmount("max_amount")
+	if err != nil {
+		return f, err
+	}
+
+	if s := q.Get("category_id"); s != "" {
+		id, err := strconv.Atoi(s)
+		if err != nil {
+			return f, fmt.Errorf("bad category_id %q", s)
+		}
+		f.CategoryId = &id
+	}
+	if s := q.Get("pending"); s != "" {
+		pending, err := strconv.ParseBool(s)
+		if err != nil {
+			return f, fmt.Errorf("bad pending %q", s)
+		}
+		f.Pending = &pending
+	}
+	if s := q.Get("include_deleted"); s != "" {
+		if f.IncludeDeleted, err = strconv.ParseBool(s); err != nil {
+			return f, fmt.Errorf("bad include_deleted %q", s)
+		}
+	}
+	if s := q.Get("include_hidden"); s != "" {
+		if f.IncludeHidden, err = strconv.ParseBool(s); err != nil {
+			return f, fmt.Errorf("bad include_hidden %q", s)
+		}
+	}
+	if s := q.Get("limit"); s != "" {
+		if f.Limit, err = strconv.Atoi(s); err != nil || f.Limit <= 0 {
+			return f, fmt.Errorf("bad limit %q", s)
+		}
+		if f.Limit > maxTransactionsLimit {
+			f.Limit = maxTransactionsLimit
+		}
+	}
+	if s := q.Get("cursor"); s != "" {
+		if f.After, err = ParseTransactionCursor(s); err != nil {
+			return f, err
+		}
+		if (f.Sort != "" && f.Sort != "date") || f.Ascending {
+			return f, errors.New("cursor requires sorting by date, newest first")
+		}
+	}
+
+	return f, nil
+}
+
+// listTransactions serves GET /api/transactions. See ParseTransactionFilter
+// for the supported query parameters. next_cursor is set when there are more
+// transactions, pass it back as cursor to get the next page.
+func (srv *Server) listTransactions() http.HandlerFunc {
+	type response struct {
+		ErrorMsg     string         `json:",omitempty"`
+		Transactions []*Transaction `json:"transactions"`
+		NextCursor   string         `json:"next_cursor,omitempty"`
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+
+		var resp response
+
+		f, err := ParseTransactionFilter(req.URL.Query())
+		if err != nil {
+			resp.ErrorMsg = err.Error()
+			returnJSON(w, http.StatusBadRequest, resp)
+			return
+		}
+
+		// Fetch one extra to find out if there is another page
+		limit := f.Limit
+		f.Limit++
+		txns, err := srv.db.QueryTransactions(req.Context(), f)
+		if err != nil {
+			resp.ErrorMsg = err.Error()
+			returnJSON(w, http.StatusInternalServerError, resp)
+			return
+		}
+
+		if len(txns) > limit {
+			txns = txns[:limit]
+			last := txns[limit-1]
+			resp.NextCursor = TransactionCursor{Date: last.Date, Id: last.Id}.String()
+		}
+		resp.Transactions = txns
+		if resp.Transactions == nil {
+			resp.Transactions = []*Transaction{}
+		}
+
+		returnJSON(w, http.StatusOK, resp)
+	}
+}
+
+// transactionsPage renders transactions matching the same query parameters as
+// the API, with a running total in the displayed order.
+func (srv *Server) transactionsPage() http.HandlerFunc {
+	type row struct {
+		*Transaction
+		Institution  *Institution
+		RunningTotal float64
+	}
+
+	type page struct {
+		ErrorMsg     string
+		Query        url.Values
+		Rows         []row
+		Total        float64
+		Accounts     []*Account
+		Institutions []*Institution
+		Categories   []CategoryPath
+		CategoryPath map[int]string
+		NextPage     string // query string of the next page, if there is one
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+
+		ctx := req.Context()
+		q := req.URL.Query()
+		p := page{Query: q}
+
+		var err error
+		if p.Accounts, err = srv.db.RetrieveAccounts(ctx); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if p.Institutions, err = srv.db.RetrieveInstitutions(ctx); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		categories, err := srv.db.RetrieveCategories(ctx)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		p.Categories = categoryPaths(categories)
+		p.CategoryPath = make(map[int]string, len(p.Categories))
+		for _, c := range p.Categories {
+			p.CategoryPath[c.Id] = c.Path
+		}
+		institutions := make(map[string]*Institution, len(p.Institutions))
+		for _, inst := range p.Institutions {
+			institutions[inst.PlaidInstitutionId] = inst
+		}
+
+		f, err := ParseTransactionFilter(q)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			p.ErrorMsg = err.Error()
+			transactionsTmpl.Execute(w, p)
+			return
+		}
+		if q.Get("limit") == "" {
+			f.Limit = maxTransactionsLimit
+		}
+
+		limit := f.Limit
+		f.Limit++
+		txns, err := srv.db.QueryTransactions(ctx, f)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(txns) > limit {
+			txns = txns[:limit]
+			if (f.Sort == "" || f.Sort == "date") && !f.Ascending {
+				last := txns[limit-1]
+				next := url.Values{}
+				for k, v := range q {
+					next[k] = v
+				}
+				next.Set("cursor", TransactionCursor{Date: last.Date, Id: last.Id}.String())
+				p.NextPage = next.Encode()
+			}
+		}
+
+		p.Rows = make([]row, len(txns))
+		for i, txn := range txns {
+			p.Total += txn.Amount
+			p.Rows[i] = row{txn, institutions[txn.InstitutionId], p.Total}
+		}
+
+		transactionsTmpl.Execute(w, p)
+	}
+}
@@ -0,0 +1,77 @@
+package expenses
+
+import (
+	"context"
+	"net/url"
+	"testing"
+
+	"github.com/plaid/plaid-go/v12/plaid"
+)
+
+func TestQueryTransactionsPagination(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+
+	added := []plaid.Transaction{
+		testTransaction("t1", "a1", "2023-06-01", "Costco", 100),
+		testTransaction("t2", "a1", "2023-06-01", "Safeway", 20),
+		testTransaction("t3", "a2", "2023-06-02", "Costco", 5),
+		testTransaction("t4", "a1", "2023-06-03", "Netflix", 15.99),
+	}
+	if _, err := db.UpdatePlaidTransactions(ctx, added, nil, nil, "item1", "c1"); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := ParseTransactionFilter(url.Values{"limit": {"2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for {
+		page, err := db.QueryTransactions(ctx, f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, txn := range page {
+			ids = append(ids, txn.PlaidTransactionId)
+		}
+		if len(page) < f.Limit {
+			break
+		}
+		last := page[len(page)-1]
+		f.After = &TransactionCursor{Date: last.Date, Id: last.Id}
+	}
+	if got, want := len(ids), 4; got != want || ids[0] != "t4" || ids[3] != "t1" {
+		t.Errorf("paged through %v, want newest first t4..t1", ids)
+	}
+
+	f, err = ParseTransactionFilter(url.Values{"q": {"cost"}, "min_amount": {"10"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	txns, err := db.QueryTransactions(ctx, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txns) != 1 || txns[0].PlaidTransactionId != "t1" {
+		t.Errorf("filtered to %+v, want only t1", txns)
+	}
+
+	// An empty account, as submitted by "All accounts", doesn't filter
+	for _, accounts := range [][]string{{""}, {"", "a2"}} {
+		f, err = ParseTransactionFilter(url.Values{"account": accounts})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if txns, err = db.QueryTransactions(ctx, f); err != nil {
+			t.Fatal(err)
+		}
+		if want := map[int]int{1: 4, 2: 1}[len(accounts)]; len(txns) != want {
+			t.Errorf("got %d transactions for account=%q, want %d", len(txns), accounts, want)
+		}
+	}
+
+	if _, err := ParseTransactionFilter(url.Values{"start": {"June"}}); err == nil {
+		t.Error("expected bad start date to be rejected")
+	}
+}
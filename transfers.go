@@ -0,0 +1,391 @@
+package expenses
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// Statuses of transfer pairs
+const (
+	TransferMatched  = "matched"
+	TransferReview   = "review"
+	TransferRejected = "rejected"
+)
+
+// Legs of a transfer can post this many days apart
+const transferMatchDays = 5
+
+var (
+	errUnknownTransferPair = errors.New("unknown transfer pair")
+	errTransferStatus      = errors.New("status must be matched, review or rejected")
+)
+
+// TransferLeg is one side of a transfer pair
+type TransferLeg struct {
+	TransactionId string  `json:"transaction_id"`
+	AccountId     string  `json:"account_id"`
+	AccountName   string  `json:"account_name"`
+	Date          string  `json:"date"`
+	Name          string  `json:"name"`
+	Amount        float64 `json:"amount"`
+}
+
+// TransferPair is money that left one of our accounts, Out, and arrived in
+// another, In
+type TransferPair struct {
+	Id     int         `json:"id"`
+	Status string      `json:"status"`
+	Out    TransferLeg `json:"out"`
+	In     TransferLeg `json:"in"`
+}
+
+// TransferMatches counts the pairs found by one run of the matcher
+type TransferMatches struct {
+	Matched int `json:"matched"`
+	Review  int `json:"review"`
+}
+
+// transferCandidate is a transaction that may be a leg of a transfer
+type transferCandidate struct {
+	id, accountId string
+	date          time.Time
+	cents         int64
+}
+
+// MatchTransfers pairs transactions in different linked accounts that move
+// the same amount in opposite directions within transferMatchDays of each
+// other. A pair is matched when neither leg has any other candidate,
+// otherwise every candidate pair goes to review. Pending and deleted
+// transactions, those classified by hand and those already paired or in
+// review are left alone.
+func (db *DB) MatchTransfers(ctx context.Context) (*TransferMatches, error) {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(
+		ctx,
+		`SELECT t.plaid_transaction_id, t.plaid_account_id, t.date, t.amount
+		 FROM transactions t
+		 JOIN accounts a ON a.plaid_account_id=t.plaid_account_id
+		 LEFT JOIN transaction_overrides o ON o.plaid_transaction_id=t.plaid_transaction_id
+		 WHERE t.deleted_at IS NULL AND NOT t.pending AND o.kind IS NULL AND t.amount<>0
+			AND NOT EXISTS (
+				SELECT 1 FROM transfer_pairs tp
+				WHERE tp.status<>'rejected' AND t.plaid_transaction_id IN (tp.out_transaction_id, tp.in_transaction_id))
+		 ORDER BY t.date, t.id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var outs []*transferCandidate
+	ins := make(map[int64][]*transferCandidate) // by cents moved
+	for rows.Next() {
+		c := new(transferCandidate)
+		var date string
+		var amount float64
+		if err := rows.Scan(&c.id, &c.accountId, &date, &amount); err != nil {
+			return nil, err
+		}
+		if c.date, err = time.Parse(time.DateOnly, date); err != nil {
+			return nil, err
+		}
+		c.cents = toCents(amount)
+		if c.cents > 0 {
+			outs = append(outs, c)
+		} else {
+			c.cents = -c.cents
+			ins[c.cents] = append(ins[c.cents], c)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	rejected, err := rejectedTransferPairs(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+
+	type pair struct{ out, in *transferCandidate }
+	var pairs []pair
+	candidates := make(map[*transferCandidate]int)
+	window := transferMatchDays * 24 * time.Hour
+	for _, out := range outs {
+		for _, in := range ins[out.cents] {
+			diff := in.date.Sub(out.date)
+			if in.accountId == out.accountId || diff > window || diff < -window || rejected[[2]string{out.id, in.id}] {
+				continue
+			}
+			pairs = append(pairs, pair{out, in})
+			candidates[out]++
+			candidates[in]++
+		}
+	}
+
+	matches := &TransferMatches{}
+	for _, p := range pairs {
+		status := TransferReview
+		if candidates[p.out] == 1 && candidates[p.in] == 1 {
+			status = TransferMatched
+		}
+		res, err := tx.ExecContext(
+			ctx,
+			`INSERT INTO transfer_pairs (out_transaction_id, in_transaction_id, status)
+			 VALUES ($1, $2, $3)
+			 ON CONFLICT (out_transaction_id, in_transaction_id) DO NOTHING`, p.out.id, p.in.id, status)
+		if err != nil {
+			return nil, err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return nil, err
+		} else if n == 0 {
+			continue
+		}
+		if status == TransferMatched {
+			matches.Matched++
+		} else {
+			matches.Review++
+		}
+	}
+
+	return matches, tx.Commit()
+}
+
+func rejectedTransferPairs(ctx context.Context, q queryer) (map[[2]string]bool, error) {
+	rows, err := q.QueryContext(
+		ctx,
+		`SELECT out_transaction_id, in_transaction_id FROM transfer_pairs WHERE status='rejected'`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rejected := make(map[[2]string]bool)
+	for rows.Next() {
+		var legs [2]string
+		if err := rows.Scan(&legs[0], &legs[1]); err != nil {
+			return nil, err
+		}
+		rejected[legs] = true
+	}
+
+	return rejected, rows.Err()
+}
+
+// RetrieveTransferPairs returns the pairs with status, newest first
+func (db *DB) RetrieveTransferPairs(ctx context.Context, status string) ([]*TransferPair, error) {
+	rows, err := db.db.QueryContext(
+		ctx,
+		`SELECT tp.id, tp.status,
+			t1.plaid_transaction_id, t1.plaid_account_id, COALESCE(NULLIF(a1.name, ''), t1.plaid_account_id), t1.date, t1.name, t1.amount,
+			t2.plaid_transaction_id, t2.plaid_account_id, COALESCE(NULLIF(a2.name, ''), t2.plaid_account_id), t2.date, t2.name, t2.amount
+		 FROM transfer_pairs tp
+		 JOIN transactions t1 ON t1.plaid_transaction_id=tp.out_transaction_id
+		 JOIN transactions t2 ON t2.plaid_transaction_id=tp.in_transaction_id
+		 LEFT JOIN accounts a1 ON a1.plaid_account_id=t1.plaid_account_id
+		 LEFT JOIN accounts a2 ON a2.plaid_account_id=t2.plaid_account_id
+		 WHERE tp.status=$1
+		 ORDER BY t1.date DESC, tp.id DESC`, status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pairs []*TransferPair
+	for rows.Next() {
+		p := new(TransferPair)
+		err := rows.Scan(&p.Id, &p.Status,
+			&p.Out.TransactionId, &p.Out.AccountId, &p.Out.AccountName, &p.Out.Date, &p.Out.Name, &p.Out.Amount,
+			&p.In.TransactionId, &p.In.AccountId, &p.In.AccountName, &p.In.Date, &p.In.Name, &p.In.Amount)
+		if err != nil {
+			return nil, err
+		}
+		pairs = append(pairs, p)
+	}
+
+	return pairs, rows.Err()
+}
+
+// ReviewTransferPair matches or rejects a pair. Matching a pair rejects the
+// other pairs in review that share one of its legs.
+func (db *DB) ReviewTransferPair(ctx context.Context, id int, match bool) error {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	status := TransferRejected
+	if match {
+		status = TransferMatched
+	}
+	res, err := tx.ExecContext(
+		ctx,
+		`UPDATE transfer_pairs SET status=$1, updated_at=CURRENT_TIMESTAMP WHERE id=$2`, status, id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errUnknownTransferPair
+	}
+
+	if match {
+		_, err = tx.ExecContext(
+			ctx,
+			`UPDATE transfer_pairs SET status='rejected', updated_at=CURRENT_TIMESTAMP
+			 WHERE status='review' AND id<>$1 AND EXISTS (
+				SELECT 1 FROM transfer_pairs m WHERE m.id=$1
+				AND (transfer_pairs.out_transaction_id IN (m.out_transaction_id, m.in_transaction_id)
+					OR transfer_pairs.in_transaction_id IN (m.out_transaction_id, m.in_transaction_id)))`, id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// transferPairs lists the pairs with the status query parameter, by default
+// those waiting for review
+func (srv *Server) transferPairs() http.HandlerFunc {
+	type response struct {
+		ErrorMsg string          `json:",omitempty"`
+		Pairs    []*TransferPair `json:"pairs"`
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+
+		var resp response
+
+		status := req.URL.Query().Get("status")
+		if status == "" {
+			status = TransferReview
+		}
+		if status != TransferMatched && status != TransferReview && status != TransferRejected {
+			resp.ErrorMsg = errTransferStatus.Error()
+			returnJSON(w, http.StatusBadRequest, resp)
+			return
+		}
+
+		pairs, err := srv.db.RetrieveTransferPairs(req.Context(), status)
+		if err != nil {
+			resp.ErrorMsg = err.Error()
+			returnJSON(w, http.StatusInternalServerError, resp)
+			return
+		}
+		resp.Pairs = pairs
+		if resp.Pairs == nil {
+			resp.Pairs = []*TransferPair{}
+		}
+
+		returnJSON(w, http.StatusOK, resp)
+	}
+}
+
+func (srv *Server) matchTransfers() http.HandlerFunc {
+	type response struct {
+		ErrorMsg string `json:",omitempty"`
+		*TransferMatches
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+
+		var resp response
+
+		matches, err := srv.db.MatchTransfers(req.Context())
+		if err != nil {
+			resp.ErrorMsg = err.Error()
+			returnJSON(w, http.StatusInternalServerError, resp)
+			return
+		}
+		resp.TransferMatches = matches
+
+		returnJSON(w, http.StatusOK, resp)
+	}
+}
+
+// reviewTransferPair matches or rejects one pair, rejecting a matched pair
+// unpairs it
+func (srv *Server) reviewTransferPair() http.HandlerFunc {
+	type payload struct {
+		Id    int  `json:"id"`
+		Match bool `json:"match"`
+	}
+
+	type response struct {
+		ErrorMsg string `json:",omitempty"`
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+
+		var resp response
+
+		pay := payload{}
+		if err := json.NewDecoder(req.Body).Decode(&pay); err != nil {
+			resp.ErrorMsg = err.Error()
+			returnJSON(w, http.StatusBadRequest, resp)
+			return
+		}
+		if err := srv.db.ReviewTransferPair(req.Context(), pay.Id, pay.Match); err != nil {
+			resp.ErrorMsg = err.Error()
+			status := http.StatusInternalServerError
+			if errors.Is(err, errUnknownTransferPair) {
+				status = http.StatusNotFound
+			}
+			returnJSON(w, status, resp)
+			return
+		}
+
+		returnJSON(w, http.StatusOK, resp)
+	}
+}
+
+// transfersPage shows the pairs waiting for review and those matched
+func (srv *Server) transfersPage() http.HandlerFunc {
+	type page struct {
+		Review  []*TransferPair
+		Matched []*TransferPair
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+
+		var p page
+		var err error
+		if p.Review, err = srv.db.RetrieveTransferPairs(req.Context(), TransferReview); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if p.Matched, err = srv.db.RetrieveTransferPairs(req.Context(), TransferMatched); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		transfersTmpl.Execute(w, p)
+	}
+}
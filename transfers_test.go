@@ -0,0 +1,116 @@
+package expenses
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/plaid/plaid-go/v12/plaid"
+)
+
+func TestMatchTransfers(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+
+	accounts := []Account{{PlaidAccountId: "checking"}, {PlaidAccountId: "card"}, {PlaidAccountId: "savings"}}
+	if err := db.CreateAccounts(ctx, accounts, "item1", "ins_1"); err != nil {
+		t.Fatal(err)
+	}
+	added := []plaid.Transaction{
+		// A card payment
+		testTransaction("t1", "checking", "2023-06-05", "Card payment", 200),
+		testTransaction("t2", "card", "2023-06-07", "Payment received", -200),
+		// Either savings or the card could have received this
+		testTransaction("t3", "checking", "2023-06-10", "Transfer", 50),
+		testTransaction("t4", "savings", "2023-06-10", "Transfer", -50),
+		testTransaction("t5", "card", "2023-06-11", "Refund", -50),
+		// The other side isn't one of our accounts
+		testTransaction("t6", "checking", "2023-06-12", "Rent", 75),
+		testTransaction("t7", "elsewhere", "2023-06-12", "Rent", -75),
+		// Too far apart
+		testTransaction("t8", "checking", "2023-06-01", "Transfer", 30),
+		testTransaction("t9", "savings", "2023-06-20", "Transfer", -30),
+	}
+	if _, err := db.UpdatePlaidTransactions(ctx, added, nil, nil, "item1", "c1"); err != nil {
+		t.Fatal(err)
+	}
+
+	match := func(matched, review int) {
+		t.Helper()
+		got, err := db.MatchTransfers(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Matched != matched || got.Review != review {
+			t.Errorf("got %+v, want %d matched and %d to review", got, matched, review)
+		}
+	}
+	transfers := func() map[string]bool {
+		t.Helper()
+		txns, err := db.QueryTransactions(ctx, TransactionFilter{Kind: KindTransfer})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make(map[string]bool)
+		for _, txn := range txns {
+			got[txn.PlaidTransactionId] = true
+		}
+		return got
+	}
+
+	match(1, 2)
+	if got := transfers(); len(got) != 2 || !got["t1"] || !got["t2"] {
+		t.Errorf("got transfers %v, want t1 and t2", got)
+	}
+	// Nothing new to match
+	match(0, 0)
+
+	review, err := db.RetrieveTransferPairs(ctx, TransferReview)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(review) != 2 {
+		t.Fatalf("got %d pairs to review, want 2", len(review))
+	}
+	var savings *TransferPair
+	for _, p := range review {
+		if p.In.TransactionId == "t4" {
+			savings = p
+		}
+	}
+	if savings == nil || savings.Out.TransactionId != "t3" || savings.Out.Amount != 50 {
+		t.Fatalf("got pairs to review %+v, want t3 to t4 among them", review)
+	}
+
+	// Matching one pair rejects the other candidate
+	if err := db.ReviewTransferPair(ctx, savings.Id, true); err != nil {
+		t.Fatal(err)
+	}
+	if review, err = db.RetrieveTransferPairs(ctx, TransferReview); err != nil || len(review) != 0 {
+		t.Errorf("got %d pairs to review after matching, want none (%v)", len(review), err)
+	}
+	if got := transfers(); len(got) != 4 || !got["t3"] || !got["t4"] || got["t5"] {
+		t.Errorf("got transfers %v, want t1 to t4", got)
+	}
+
+	// Unpairing a match sticks
+	matched, err := db.RetrieveTransferPairs(ctx, TransferMatched)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range matched {
+		if p.Out.TransactionId == "t1" {
+			if err := db.ReviewTransferPair(ctx, p.Id, false); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	match(0, 0)
+	if got := transfers(); got["t1"] || got["t2"] {
+		t.Errorf("got transfers %v, want t1 and t2 unpaired", got)
+	}
+
+	if err := db.ReviewTransferPair(ctx, 1000, true); !errors.Is(err, errUnknownTransferPair) {
+		t.Errorf("got %v reviewing a missing pair, want %v", err, errUnknownTransferPair)
+	}
+}
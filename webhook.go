@@ -0,0 +1,302 @@
+package expenses
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/plaid/plaid-go/v12/plaid"
+)
+
+const (
+	// Webhooks older than this are rejected as possible replays
+	webhookMaxAge = 5 * time.Minute
+	// Allowance for Plaid's clock running ahead of ours
+	webhookMaxSkew = time.Minute
+	// How long a fetched verification key is trusted before asking Plaid
+	// whether it has expired
+	webhookKeyTTL = 24 * time.Hour
+	// Keys are fetched before a webhook is authenticated, so failed lookups
+	// are remembered for a while and fetches from Plaid are rate limited
+	webhookKeyRetry         = time.Minute
+	webhookKeyFetchInterval = 5 * time.Second
+	// Plaid webhook bodies are small, anything bigger is not from Plaid
+	webhookMaxBody = 1 << 20
+)
+
+var (
+	errWebhookUnverified     = errors.New("webhook verification failed")
+	errWebhookKeyRateLimited = errors.New("too many webhook key fetches")
+)
+
+// webhookKey is a cached verification key, or the error fetching it
+type webhookKey struct {
+	key       *ecdsa.PublicKey
+	expired   bool
+	err       error
+	fetchedAt time.Time
+}
+
+// webhookVerifier checks the Plaid-Verification JWT sent with every Plaid
+// webhook, see https://plaid.com/docs/api/webhooks/webhook-verification/
+type webhookVerifier struct {
+	fetchKey func(ctx context.Context, kid string) (plaid.JWKPublicKey, error)
+	now      func() time.Time
+
+	mu        sync.Mutex
+	keys      map[string]*webhookKey
+	lastFetch time.Time
+}
+
+func newWebhookVerifier(client *plaid.APIClient) *webhookVerifier {
+	return &webhookVerifier{
+		fetchKey: func(ctx context.Context, kid string) (plaid.JWKPublicKey, error) {
+			wvkreq := plaid.NewWebhookVerificationKeyGetRequest(kid)
+			wvkres, _, err := client.PlaidApi.WebhookVerificationKeyGet(ctx).WebhookVerificationKeyGetRequest(*wvkreq).Execute()
+			return wvkres.Key, err
+		},
+		now:  time.Now,
+		keys: make(map[string]*webhookKey),
+	}
+}
+
+// key returns the verification key with id kid, fetching it from Plaid if it
+// isn't cached or the cached copy is stale. The fetch happens outside the lock
+// so a slow Plaid doesn't hold up webhooks whose key is cached.
+func (v *webhookVerifier) key(ctx context.Context, kid string) (*webhookKey, error) {
+	v.mu.Lock()
+	now := v.now()
+	cached, ok := v.keys[kid]
+	switch {
+	case ok && cached.err != nil && now.Sub(cached.fetchedAt) < webhookKeyRetry:
+		v.mu.Unlock()
+		return nil, cached.err
+	case ok && cached.err == nil && now.Sub(cached.fetchedAt) < webhookKeyTTL:
+		v.mu.Unlock()
+		return cached, nil
+	case now.Sub(v.lastFetch) < webhookKeyFetchInterval:
+		v.mu.Unlock()
+		if ok && cached.err == nil {
+			// Stale but still usable until the next fetch is allowed
+			return cached, nil
+		}
+		return nil, errWebhookKeyRateLimited
+	}
+	v.lastFetch = now
+	v.mu.Unlock()
+
+	wk, err := v.fetchWebhookKey(ctx, kid)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if err != nil {
+		// Drop earlier failures that have run their course so made up key
+		// ids don't accumulate
+		for id, old := range v.keys {
+			if old.err != nil && now.Sub(old.fetchedAt) >= webhookKeyRetry {
+				delete(v.keys, id)
+			}
+		}
+		v.keys[kid] = &webhookKey{err: err, fetchedAt: now}
+		return nil, err
+	}
+	v.keys[kid] = wk
+
+	return wk, nil
+}
+
+// fetchWebhookKey fetches and decodes the verification key with id kid
+func (v *webhookVerifier) fetchWebhookKey(ctx context.Context, kid string) (*webhookKey, error) {
+	jwk, err := v.fetchKey(ctx, kid)
+	if err != nil {
+		return nil, err
+	}
+	if jwk.Kty != "EC" || jwk.Crv != "P-256" {
+		return nil, fmt.Errorf("unsupported webhook key type %s %s", jwk.Kty, jwk.Crv)
+	}
+	x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+	if err != nil {
+		return nil, err
+	}
+	y, err := base64.RawURLEncoding.DecodeString(jwk.Y)
+	if err != nil {
+		return nil, err
+	}
+
+	wk := &webhookKey{
+		key: &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		},
+		expired:   jwk.ExpiredAt.Get() != nil,
+		fetchedAt: v.now(),
+	}
+
+	return wk, nil
+}
+
+// verify checks that token is a valid ES256 JWT signed by Plaid, that it was
+// issued recently and that it covers body.
+func (v *webhookVerifier) verify(ctx context.Context, token string, body []byte) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("%w: malformed JWT", errWebhookUnverified)
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTSegment(parts[0], &header); err != nil {
+		return fmt.Errorf("%w: %v", errWebhookUnverified, err)
+	}
+	if header.Alg != "ES256" {
+		return fmt.Errorf("%w: unexpected algorithm %q", errWebhookUnverified, header.Alg)
+	}
+
+	wk, err := v.key(ctx, header.Kid)
+	if err != nil {
+		return fmt.Errorf("fetching webhook key %s: %w", header.Kid, err)
+	}
+	if wk.expired {
+		return fmt.Errorf("%w: key %s has expired", errWebhookUnverified, header.Kid)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(sig) != 64 {
+		return fmt.Errorf("%w: malformed signature", errWebhookUnverified)
+	}
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+	if !ecdsa.Verify(wk.key, hash[:], r, s) {
+		return fmt.Errorf("%w: bad signature", errWebhookUnverified)
+	}
+
+	var claims struct {
+		IssuedAt          int64  `json:"iat"`
+		RequestBodySHA256 string `json:"request_body_sha256"`
+	}
+	if err := decodeJWTSegment(parts[1], &claims); err != nil {
+		return fmt.Errorf("%w: %v", errWebhookUnverified, err)
+	}
+	age := v.now().Sub(time.Unix(claims.IssuedAt, 0))
+	if age > webhookMaxAge {
+		return fmt.Errorf("%w: token is too old", errWebhookUnverified)
+	}
+	if age < -webhookMaxSkew {
+		return fmt.Errorf("%w: token is from the future", errWebhookUnverified)
+	}
+
+	bodyHash := sha256.Sum256(body)
+	if subtle.ConstantTimeCompare([]byte(hex.EncodeToString(bodyHash[:])), []byte(claims.RequestBodySHA256)) != 1 {
+		return fmt.Errorf("%w: body hash mismatch", errWebhookUnverified)
+	}
+
+	return nil
+}
+
+func decodeJWTSegment(seg string, v any) error {
+	js, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(js, v)
+}
+
+// plaidWebhook receives webhooks from Plaid and dispatches them to transaction
+// syncs or item status changes.
+func (srv *Server) plaidWebhook() http.HandlerFunc {
+	type payload struct {
+		WebhookType string `json:"webhook_type"`
+		WebhookCode string `json:"webhook_code"`
+		ItemId      string `json:"item_id"`
+		Error       *struct {
+			ErrorCode string `json:"error_code"`
+		} `json:"error"`
+	}
+
+	type response struct {
+		ErrorMsg string `json:",omitempty"`
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+
+		var resp response
+
+		body, err := io.ReadAll(io.LimitReader(req.Body, webhookMaxBody))
+		if err != nil {
+			resp.ErrorMsg = err.Error()
+			returnJSON(w, http.StatusBadRequest, resp)
+			return
+		}
+
+		err = srv.webhooks.verify(req.Context(), req.Header.Get("Plaid-Verification"), body)
+		if err != nil {
+			log.Printf("Rejected webhook: %v", err)
+			resp.ErrorMsg = errWebhookUnverified.Error()
+			returnJSON(w, http.StatusUnauthorized, resp)
+			return
+		}
+
+		pay := payload{}
+		if err = json.Unmarshal(body, &pay); err != nil {
+			resp.ErrorMsg = err.Error()
+			returnJSON(w, http.StatusBadRequest, resp)
+			return
+		}
+		log.Printf("Webhook %s %s for item %s", pay.WebhookType, pay.WebhookCode, pay.ItemId)
+
+		switch {
+		case pay.WebhookType == "TRANSACTIONS" && pay.WebhookCode == "SYNC_UPDATES_AVAILABLE":
+			item, err := srv.db.RetrieveItemByPlaidItemId(req.Context(), pay.ItemId)
+			if err != nil {
+				resp.ErrorMsg = err.Error()
+				returnJSON(w, http.StatusInternalServerError, resp)
+				return
+			}
+			if item != nil {
+				// Plaid expects a prompt response, sync in the background
+				srv.runInBackground(func(ctx context.Context) {
+					if _, err := srv.syncItem(ctx, item); err != nil {
+						log.Printf("Webhook sync of item %s failed: %v", item.PlaidItemId, err)
+					}
+				})
+			}
+		case pay.WebhookType == "ITEM" && pay.WebhookCode == "ERROR" && pay.Error != nil && pay.Error.ErrorCode == "ITEM_LOGIN_REQUIRED":
+			err = srv.db.UpdateItemStatus(req.Context(), pay.ItemId, ItemStatusLoginRequired)
+		case pay.WebhookType == "ITEM" && pay.WebhookCode == "ERROR":
+			err = srv.db.UpdateItemStatus(req.Context(), pay.ItemId, ItemStatusError)
+		case pay.WebhookType == "ITEM" && pay.WebhookCode == "PENDING_EXPIRATION":
+			err = srv.db.UpdateItemStatus(req.Context(), pay.ItemId, ItemStatusPendingExpiration)
+		case pay.WebhookType == "ITEM" && pay.WebhookCode == "LOGIN_REPAIRED":
+			err = srv.db.UpdateItemStatus(req.Context(), pay.ItemId, ItemStatusOK)
+		}
+		if err != nil {
+			resp.ErrorMsg = err.Error()
+			returnJSON(w, http.StatusInternalServerError, resp)
+			return
+		}
+
+		returnJSON(w, http.StatusOK, resp)
+	}
+}
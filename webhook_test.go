@@ -0,0 +1,103 @@
+package expenses
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/plaid/plaid-go/v12/plaid"
+)
+
+func signWebhook(t *testing.T, key *ecdsa.PrivateKey, iat time.Time, body []byte) string {
+	t.Helper()
+
+	enc := base64.RawURLEncoding
+	bodyHash := sha256.Sum256(body)
+	header := enc.EncodeToString([]byte(`{"alg":"ES256","kid":"key1","typ":"JWT"}`))
+	claims := enc.EncodeToString([]byte(fmt.Sprintf(`{"iat":%d,"request_body_sha256":%q}`, iat.Unix(), hex.EncodeToString(bodyHash[:]))))
+
+	hash := sha256.Sum256([]byte(header + "." + claims))
+	r, s, err := ecdsa.Sign(rand.Reader, key, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+
+	return header + "." + claims + "." + enc.EncodeToString(sig)
+}
+
+func TestWebhookVerifier(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fetches := 0
+	now := time.Unix(1686900000, 0)
+	v := &webhookVerifier{
+		fetchKey: func(ctx context.Context, kid string) (plaid.JWKPublicKey, error) {
+			fetches++
+			if kid != "key1" {
+				return plaid.JWKPublicKey{}, errors.New("unknown key")
+			}
+			return plaid.JWKPublicKey{
+				Kty: "EC",
+				Crv: "P-256",
+				Kid: kid,
+				X:   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+				Y:   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+			}, nil
+		},
+		now:  func() time.Time { return now },
+		keys: make(map[string]*webhookKey),
+	}
+
+	body := []byte(`{"webhook_type":"TRANSACTIONS","webhook_code":"SYNC_UPDATES_AVAILABLE","item_id":"item1"}`)
+	ctx := context.Background()
+
+	if err := v.verify(ctx, signWebhook(t, key, now, body), body); err != nil {
+		t.Errorf("valid webhook rejected: %v", err)
+	}
+	if err := v.verify(ctx, signWebhook(t, key, now, body), body); err != nil {
+		t.Errorf("valid webhook rejected: %v", err)
+	}
+	if fetches != 1 {
+		t.Errorf("fetched key %d times, want 1", fetches)
+	}
+
+	tests := map[string]string{
+		"tampered body": signWebhook(t, key, now, []byte(`{}`)),
+		"stale token":   signWebhook(t, key, now.Add(-10*time.Minute), body),
+		"future token":  signWebhook(t, key, now.Add(10*time.Minute), body),
+		"malformed":     "not-a-jwt",
+	}
+	for name, token := range tests {
+		if err := v.verify(ctx, token, body); !errors.Is(err, errWebhookUnverified) {
+			t.Errorf("%s: got %v, want verification failure", name, err)
+		}
+	}
+
+	// Unknown key ids are remembered and fetches from Plaid are rate limited
+	now = now.Add(webhookKeyFetchInterval)
+	for i := 0; i < 2; i++ {
+		if _, err := v.key(ctx, "made-up"); err == nil {
+			t.Error("got a key for a made up key id")
+		}
+	}
+	if _, err := v.key(ctx, "another"); !errors.Is(err, errWebhookKeyRateLimited) {
+		t.Errorf("got %v for a second unknown key, want rate limited", err)
+	}
+	if fetches != 2 {
+		t.Errorf("fetched keys %d times, want 2", fetches)
+	}
+}